@@ -0,0 +1,183 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CircuitBreaker describes passive ejection of an upstream based on the results of real requests.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive errors or timeouts ejecting the upstream. Zero disables the check
+	Failures int
+	// ServFailRate is the ratio of SERVFAIL responses within Window ejecting the upstream. Zero disables the check
+	ServFailRate float64
+	// Window is the number of the latest responses ServFailRate is computed on
+	Window int
+	// BaseEjection is the period of the first ejection. It is doubled on each consecutive ejection
+	BaseEjection time.Duration
+	// MaxEjection limits the ejection period
+	MaxEjection time.Duration
+}
+
+func (cb *CircuitBreaker) enabled() bool {
+	return cb.Failures > 0 || cb.ServFailRate > 0
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker ejects an upstream when it fails too often. When the ejection period is over the
+// upstream becomes half-open: a single trial request is let through and its result either closes
+// the breaker or ejects the upstream again for twice as long.
+type circuitBreaker struct {
+	CircuitBreaker
+	addr      string
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	servfails []bool
+	next      int
+	ejections int
+	until     time.Time
+	trial     time.Time
+}
+
+// available returns false while the upstream is ejected
+func (b *circuitBreaker) available() bool {
+	if !b.enabled() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerOpen || !time.Now().Before(b.until)
+}
+
+// allow returns true if a request can be sent to the upstream. In the half-open state only one trial
+// request at a time is allowed.
+func (b *circuitBreaker) allow() bool {
+	if !b.enabled() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if now.Before(b.until) {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+	}
+	// the trial could be picked but never sent, so it is considered lost after the request timeout
+	if !b.trial.IsZero() && now.Sub(b.trial) < maxTimeout+readTimeout {
+		return false
+	}
+	b.trial = now
+	return true
+}
+
+// report updates the breaker with the result of a request
+func (b *circuitBreaker) report(ret *dns.Msg, err error) {
+	if !b.enabled() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	servfail := err == nil && ret.Rcode == dns.RcodeServerFailure
+	switch b.state {
+	case breakerOpen:
+		return
+	case breakerHalfOpen:
+		b.trial = time.Time{}
+		if err != nil || servfail {
+			b.eject()
+		} else {
+			b.ejections = 0
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	if err != nil {
+		b.failures++
+	} else {
+		b.failures = 0
+		b.record(servfail)
+	}
+	if (b.Failures > 0 && b.failures >= b.Failures) || b.servFailRateExceeded() {
+		b.eject()
+	}
+}
+
+// record keeps whether the response was SERVFAIL in the sliding window
+func (b *circuitBreaker) record(servfail bool) {
+	if b.ServFailRate <= 0 || b.Window <= 0 {
+		return
+	}
+	if len(b.servfails) < b.Window {
+		b.servfails = append(b.servfails, servfail)
+		return
+	}
+	b.servfails[b.next] = servfail
+	b.next = (b.next + 1) % b.Window
+}
+
+func (b *circuitBreaker) servFailRateExceeded() bool {
+	if b.ServFailRate <= 0 || len(b.servfails) < b.Window {
+		return false
+	}
+	count := 0
+	for _, servfail := range b.servfails {
+		if servfail {
+			count++
+		}
+	}
+	return float64(count)/float64(len(b.servfails)) >= b.ServFailRate
+}
+
+func (b *circuitBreaker) eject() {
+	period := b.BaseEjection << b.ejections
+	if period > b.MaxEjection || period <= 0 {
+		period = b.MaxEjection
+	}
+	b.ejections++
+	b.until = time.Now().Add(period)
+	b.failures = 0
+	b.servfails = b.servfails[:0]
+	b.next = 0
+	b.setState(breakerOpen)
+	UpstreamEjectionDuration.WithLabelValues(b.addr).Set(period.Seconds())
+	log.Warningf("upstream %s is ejected for %s", b.addr, period)
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	CircuitBreakerState.WithLabelValues(b.addr).Set(float64(state))
+	if state == breakerClosed {
+		UpstreamEjectionDuration.WithLabelValues(b.addr).Set(0)
+	}
+}
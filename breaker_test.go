@@ -0,0 +1,148 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestCircuitBreaker_ConsecutiveFailures(t *testing.T) {
+	b := &circuitBreaker{CircuitBreaker: CircuitBreaker{Failures: 2, BaseEjection: 50 * time.Millisecond, MaxEjection: time.Second}}
+	timeout := errors.New("timeout")
+	b.report(nil, timeout)
+	b.report(new(dns.Msg), nil)
+	b.report(nil, timeout)
+	require.True(t, b.allow())
+	b.report(nil, timeout)
+	require.False(t, b.available())
+	require.False(t, b.allow())
+
+	<-time.After(50 * time.Millisecond)
+	require.True(t, b.available())
+	// only a single trial request is let through in the half-open state
+	require.True(t, b.allow())
+	require.False(t, b.allow())
+
+	// failed trial doubles the ejection period
+	b.report(nil, timeout)
+	require.False(t, b.allow())
+	require.Equal(t, 100*time.Millisecond, time.Until(b.until).Round(50*time.Millisecond))
+
+	<-time.After(100 * time.Millisecond)
+	require.True(t, b.allow())
+	b.report(new(dns.Msg), nil)
+	require.Equal(t, breakerClosed, b.state)
+	require.Equal(t, 0, b.ejections)
+	require.True(t, b.allow())
+	require.True(t, b.allow())
+}
+
+func TestCircuitBreaker_ServFailRate(t *testing.T) {
+	b := &circuitBreaker{CircuitBreaker: CircuitBreaker{ServFailRate: 0.5, Window: 4, BaseEjection: time.Minute, MaxEjection: time.Minute}}
+	servfail := new(dns.Msg)
+	servfail.Rcode = dns.RcodeServerFailure
+	success := new(dns.Msg)
+
+	b.report(servfail, nil)
+	b.report(servfail, nil)
+	b.report(success, nil)
+	require.True(t, b.available())
+	b.report(success, nil)
+	require.False(t, b.available())
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := 0; i < 10; i++ {
+		b.report(nil, errors.New("timeout"))
+	}
+	require.True(t, b.available())
+	require.True(t, b.allow())
+}
+
+func TestFanout_HalfOpenTrialInProgress(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	f := New()
+	f.from = "."
+	for i := 0; i < 2; i++ {
+		s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+			logErrIfNotNil(w.WriteMsg(msg))
+		})
+		defer s.close()
+		c := NewClient(s.addr, udp)
+		c.SetCircuitBreaker(CircuitBreaker{Failures: 1, BaseEjection: time.Minute, MaxEjection: time.Minute})
+		f.addClient(c)
+	}
+	ejected := f.clients[0].(*client)
+	ejected.breaker.report(nil, errors.New("timeout"))
+	require.False(t, ejected.Healthy())
+	halfOpen := f.clients[1].(*client)
+	halfOpen.breaker.state = breakerHalfOpen
+	require.True(t, halfOpen.Allow(), "the trial request should be let through")
+	require.True(t, f.hasHealthyClients())
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err := f.ServeDNS(context.TODO(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Len(t, writer.answers[0].Answer, 1)
+}
+
+func TestFanout_CircuitBreakerTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {})
+	defer s.close()
+	c := NewClient(s.addr, udp)
+	c.SetCircuitBreaker(CircuitBreaker{Failures: 2, BaseEjection: time.Minute, MaxEjection: time.Minute})
+	f := New()
+	f.from = "."
+	f.timeout = 100 * time.Millisecond
+	f.addClient(c)
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+
+	// the requests cancelled after losing the race to other upstreams are not failures
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Request(ctx, &request.Request{W: new(test.ResponseWriter), Req: req})
+	require.Error(t, err)
+	_, err = c.Request(ctx, &request.Request{W: new(test.ResponseWriter), Req: req})
+	require.Error(t, err)
+	require.True(t, c.Healthy())
+
+	for i := 0; i < 2; i++ {
+		_, err = f.ServeDNS(context.TODO(), &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}, req.Copy())
+		require.Error(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return !c.Healthy()
+	}, time.Second, 10*time.Millisecond, "the requests timed out before the read timeout should eject the upstream")
+}
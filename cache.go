@@ -0,0 +1,337 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// CacheConfig describes the response cache. Zero Capacity disables the cache.
+type CacheConfig struct {
+	// Capacity is the maximum number of cached responses
+	Capacity int
+	// MaxTTL limits the TTL of positive responses
+	MaxTTL time.Duration
+	// MaxNegativeTTL limits the TTL of NXDOMAIN and NODATA responses
+	MaxNegativeTTL time.Duration
+	// PrefetchAmount is the number of hits within PrefetchDuration making an entry popular. Zero disables prefetch
+	PrefetchAmount int
+	// PrefetchDuration is the period the hits are counted within
+	PrefetchDuration time.Duration
+	// PrefetchPercentage is the remaining part of TTL in percents after which a popular entry is prefetched
+	PrefetchPercentage int
+	// StaleDuration is the period an expired response can be served for when upstreams fail. Zero disables serve-stale
+	StaleDuration time.Duration
+	// StaleTTL is the TTL of the records of stale responses
+	StaleTTL time.Duration
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	stored      time.Time
+	ttl         time.Duration
+	hits        int
+	hitsSince   time.Time
+	prefetching bool
+	element     *list.Element
+}
+
+// responseCache is LRU cache of upstream responses
+type responseCache struct {
+	CacheConfig
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	lru     *list.List
+	now     func() time.Time
+}
+
+func newResponseCache(cfg CacheConfig) *responseCache {
+	return &responseCache{
+		CacheConfig: cfg,
+		entries:     make(map[cacheKey]*cacheEntry),
+		lru:         list.New(),
+		now:         time.Now,
+	}
+}
+
+func newCacheKey(state *request.Request) cacheKey {
+	return cacheKey{
+		name:   strings.ToLower(state.QName()),
+		qtype:  state.QType(),
+		qclass: state.QClass(),
+		do:     state.Do(),
+		cd:     state.Req.CheckingDisabled,
+	}
+}
+
+// get returns the cached response with decreased TTLs or nil if there is no fresh response.
+// The second result is true if the response should be prefetched.
+func (c *responseCache) get(key cacheKey) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	now := c.now()
+	age := now.Sub(e.stored)
+	if age >= e.ttl {
+		return nil, false
+	}
+	c.lru.MoveToFront(e.element)
+	if now.Sub(e.hitsSince) > c.PrefetchDuration {
+		e.hits, e.hitsSince = 0, now
+	}
+	e.hits++
+	prefetch := c.PrefetchAmount > 0 && !e.prefetching && e.hits >= c.PrefetchAmount &&
+		(e.ttl-age)*100 <= e.ttl*time.Duration(c.PrefetchPercentage)
+	if prefetch {
+		e.prefetching = true
+	}
+	return agedMsg(e.msg, age), prefetch
+}
+
+// getStale returns the cached response with TTLs set to StaleTTL or nil if there is no response
+// expired less than StaleDuration ago.
+func (c *responseCache) getStale(key cacheKey) *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || c.now().Sub(e.stored) >= e.ttl+c.StaleDuration {
+		return nil
+	}
+	c.lru.MoveToFront(e.element)
+	ret := e.msg.Copy()
+	ttl := uint32(c.StaleTTL / time.Second)
+	for _, section := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+	return ret
+}
+
+// set caches the response if it is cacheable. The response is stored without OPT record, as it is
+// built from the request of each client getting the response.
+func (c *responseCache) set(key cacheKey, msg *dns.Msg) {
+	ttl := c.responseTTL(msg)
+	if ttl <= 0 {
+		return
+	}
+	msg = withoutOPT(msg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if e, ok := c.entries[key]; ok {
+		e.msg, e.stored, e.ttl, e.prefetching = msg, now, ttl, false
+		c.lru.MoveToFront(e.element)
+		return
+	}
+	e := &cacheEntry{key: key, msg: msg, stored: now, ttl: ttl, hitsSince: now}
+	e.element = c.lru.PushFront(e)
+	c.entries[key] = e
+	for c.lru.Len() > c.Capacity {
+		oldest := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, oldest.key)
+	}
+}
+
+// prefetched resets prefetching state of the entry if the prefetch has failed
+func (c *responseCache) prefetched(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.prefetching = false
+	}
+}
+
+// responseTTL returns the time the response can be cached for. Positive responses are cached for the minimal TTL
+// of their records, negative ones for the minimum of SOA TTL and SOA MINIMUM field (RFC 2308).
+func (c *responseCache) responseTTL(msg *dns.Msg) time.Duration {
+	if msg.Truncated {
+		return 0
+	}
+	switch {
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0:
+		ttl := minTTL(msg.Answer)
+		if ns := minTTL(msg.Ns); len(msg.Ns) > 0 && ns < ttl {
+			ttl = ns
+		}
+		return capTTL(ttl, c.MaxTTL)
+	case msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError:
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				return capTTL(ttl, c.MaxNegativeTTL)
+			}
+		}
+	}
+	return 0
+}
+
+func minTTL(rrs []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+func capTTL(ttl uint32, limit time.Duration) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d > limit {
+		return limit
+	}
+	return d
+}
+
+// withoutOPT returns the copy of the message without OPT record
+func withoutOPT(msg *dns.Msg) *dns.Msg {
+	ret := msg.Copy()
+	extra := ret.Extra[:0]
+	for _, rr := range ret.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	ret.Extra = extra
+	return ret
+}
+
+// replyTo adapts the cached response to the request: ID, question and EDNS are taken from the request
+// and the response is truncated to the buffer size of the client.
+func replyTo(state *request.Request, msg *dns.Msg) *dns.Msg {
+	msg.Id = state.Req.Id
+	msg.Question = state.Req.Question
+	state.SizeAndDo(msg)
+	return state.Scrub(msg)
+}
+
+// agedMsg returns the copy of the message with TTLs decreased by the age
+func agedMsg(msg *dns.Msg, age time.Duration) *dns.Msg {
+	ret := msg.Copy()
+	elapsed := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return ret
+}
+
+// cachedReply returns the cached response to the request or nil if there is no fresh response.
+// Popular responses are prefetched in background from the fastest upstream.
+func (f *Fanout) cachedReply(state *request.Request) *dns.Msg {
+	key := newCacheKey(state)
+	msg, prefetch := f.cache.get(key)
+	if msg == nil {
+		CacheMissCount.Add(1)
+		return nil
+	}
+	CacheHitCount.Add(1)
+	if prefetch {
+		req := new(dns.Msg)
+		req.SetQuestion(state.QName(), state.QType())
+		req.Question[0].Qclass = state.QClass()
+		req.CheckingDisabled = state.Req.CheckingDisabled
+		if state.Do() {
+			req.SetEdns0(uint16(state.Size()), true)
+		}
+		go f.prefetch(key, req)
+	}
+	return replyTo(state, msg)
+}
+
+// staleReply returns the stale response to the request with extended DNS error "Stale Answer"
+// or nil if there is no such response.
+func (f *Fanout) staleReply(state *request.Request) *dns.Msg {
+	if f.cache == nil || f.cache.StaleDuration == 0 {
+		return nil
+	}
+	msg := f.cache.getStale(newCacheKey(state))
+	if msg == nil {
+		return nil
+	}
+	CacheStaleCount.Add(1)
+	if opt := state.Req.IsEdns0(); opt != nil {
+		msg.SetEdns0(opt.UDPSize(), opt.Do())
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+	return replyTo(state, msg)
+}
+
+// prefetch refreshes the cached response using the fastest available upstream
+func (f *Fanout) prefetch(key cacheKey, req *dns.Msg) {
+	c := f.fastestClient()
+	if c == nil {
+		f.cache.prefetched(key)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	msg, err := c.Request(ctx, &request.Request{Req: req})
+	if err != nil || msg.Rcode == dns.RcodeServerFailure {
+		f.cache.prefetched(key)
+		return
+	}
+	CachePrefetchCount.Add(1)
+	f.cache.set(key, msg)
+}
+
+// fastestClient returns the available client with the lowest RTT. Measured clients are preferred
+func (f *Fanout) fastestClient() Client {
+	var fastest Client
+	for _, c := range f.clients {
+		if !c.Healthy() {
+			continue
+		}
+		if fastest == nil || c.RTT() > 0 && (fastest.RTT() == 0 || c.RTT() < fastest.RTT()) {
+			fastest = c
+		}
+	}
+	return fastest
+}
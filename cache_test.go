@@ -0,0 +1,274 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func newTestCache(cfg CacheConfig) (*responseCache, *time.Time) {
+	now := time.Now()
+	c := newResponseCache(cfg)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestResponseCache_TTL(t *testing.T) {
+	c := newResponseCache(CacheConfig{Capacity: 1, MaxTTL: time.Minute, MaxNegativeTTL: 10 * time.Second})
+
+	answer := new(dns.Msg)
+	answer.Answer = []dns.RR{test.A("example.org. 300 IN A 10.0.0.1"), test.A("example.org. 30 IN A 10.0.0.2")}
+	require.Equal(t, 30*time.Second, c.responseTTL(answer))
+	answer.Answer[1].Header().Ttl = 600
+	require.Equal(t, time.Minute, c.responseTTL(answer), "TTL should be capped")
+
+	nxdomain := new(dns.Msg)
+	nxdomain.Rcode = dns.RcodeNameError
+	nxdomain.Ns = []dns.RR{test.SOA("example.org. 5 IN SOA ns.example.org. admin.example.org. 1 2 3 4 60")}
+	require.Equal(t, 5*time.Second, c.responseTTL(nxdomain))
+	nxdomain.Ns[0].Header().Ttl = 3600
+	require.Equal(t, 10*time.Second, c.responseTTL(nxdomain), "negative TTL should be capped")
+
+	nodata := new(dns.Msg)
+	require.Zero(t, c.responseTTL(nodata), "negative responses without SOA shouldn't be cached")
+
+	servfail := new(dns.Msg)
+	servfail.Rcode = dns.RcodeServerFailure
+	servfail.Ns = nxdomain.Ns
+	require.Zero(t, c.responseTTL(servfail))
+
+	answer.Truncated = true
+	require.Zero(t, c.responseTTL(answer))
+}
+
+func TestResponseCache_GetSet(t *testing.T) {
+	c, now := newTestCache(CacheConfig{Capacity: 2, MaxTTL: time.Hour, MaxNegativeTTL: time.Hour})
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{test.A("example.org. 60 IN A 10.0.0.1")}
+	key := cacheKey{name: "example.org.", qtype: dns.TypeA, qclass: dns.ClassINET}
+	c.set(key, msg)
+
+	*now = now.Add(20 * time.Second)
+	cached, _ := c.get(key)
+	require.NotNil(t, cached)
+	require.Equal(t, uint32(40), cached.Answer[0].Header().Ttl)
+	require.Equal(t, uint32(60), msg.Answer[0].Header().Ttl, "cached message shouldn't be modified")
+
+	do := key
+	do.do = true
+	cached, _ = c.get(do)
+	require.Nil(t, cached, "DO bit should be a part of the key")
+
+	*now = now.Add(40 * time.Second)
+	cached, _ = c.get(key)
+	require.Nil(t, cached, "expired response shouldn't be returned")
+
+	for _, name := range []string{"a.", "b.", "c."} {
+		c.set(cacheKey{name: name}, msg)
+	}
+	cached, _ = c.get(cacheKey{name: "a."})
+	require.Nil(t, cached, "least recently used response should be evicted")
+	cached, _ = c.get(cacheKey{name: "c."})
+	require.NotNil(t, cached)
+}
+
+func TestResponseCache_Prefetch(t *testing.T) {
+	c, now := newTestCache(CacheConfig{
+		Capacity:           1,
+		MaxTTL:             time.Hour,
+		PrefetchAmount:     2,
+		PrefetchDuration:   time.Minute,
+		PrefetchPercentage: 50,
+	})
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{test.A("example.org. 100 IN A 10.0.0.1")}
+	key := cacheKey{name: "example.org."}
+	c.set(key, msg)
+
+	_, prefetch := c.get(key)
+	require.False(t, prefetch)
+	*now = now.Add(40 * time.Second)
+	_, prefetch = c.get(key)
+	require.False(t, prefetch, "entry has more than a half of TTL")
+	*now = now.Add(20 * time.Second)
+	_, prefetch = c.get(key)
+	require.True(t, prefetch)
+	_, prefetch = c.get(key)
+	require.False(t, prefetch, "entry is being prefetched already")
+}
+
+func TestFanout_Cache(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var requests atomic.Int32
+	s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		requests.Add(1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	f := New()
+	f.from = "."
+	f.addClient(NewClient(s.addr, udp))
+	f.cacheConfig.Capacity = 10
+	f.cacheConfig.PrefetchAmount = 1
+	f.cacheConfig.PrefetchPercentage = 100
+	f.cache = newResponseCache(f.cacheConfig)
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err := f.ServeDNS(context.TODO(), writer, req)
+		require.NoError(t, err)
+		require.Len(t, writer.answers, 1)
+		require.Equal(t, req.Id, writer.answers[0].Id)
+		require.Len(t, writer.answers[0].Answer, 1)
+	}
+	require.Eventually(t, func() bool {
+		return requests.Load() == 2
+	}, time.Second, 10*time.Millisecond, "the second request should be answered from the cache and prefetched")
+}
+
+func TestFanout_CacheEDNS(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var requests atomic.Int32
+	s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		requests.Add(1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		for i := 0; i < 50; i++ {
+			msg.Answer = append(msg.Answer, test.A(fmt.Sprintf("%s 300 IN A 10.0.0.%d", r.Question[0].Name, i)))
+		}
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	f := New()
+	f.from = "."
+	f.addClient(NewClient(s.addr, udp))
+	f.cacheConfig.Capacity = 10
+	f.cache = newResponseCache(f.cacheConfig)
+
+	serve := func(modify func(req *dns.Msg)) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		modify(req)
+		writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err := f.ServeDNS(context.TODO(), writer, req)
+		require.NoError(t, err)
+		require.Len(t, writer.answers, 1)
+		return writer.answers[0]
+	}
+	resp := serve(func(req *dns.Msg) { req.SetEdns0(dns.DefaultMsgSize, false) })
+	require.Len(t, resp.Answer, 50)
+
+	resp = serve(func(*dns.Msg) {})
+	require.Equal(t, int32(1), requests.Load(), "the response should be cached")
+	require.Nil(t, resp.IsEdns0(), "the cached response to the request without EDNS shouldn't have OPT record")
+	require.True(t, resp.Truncated)
+	require.LessOrEqual(t, resp.Len(), dns.MinMsgSize)
+
+	serve(func(req *dns.Msg) {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		req.CheckingDisabled = true
+	})
+	require.Equal(t, int32(2), requests.Load(), "the response with checking disabled should be cached separately")
+}
+
+func TestResponseCache_Stale(t *testing.T) {
+	c, now := newTestCache(CacheConfig{Capacity: 1, MaxTTL: time.Hour, StaleDuration: time.Minute, StaleTTL: 30 * time.Second})
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{test.A("example.org. 60 IN A 10.0.0.1")}
+	key := cacheKey{name: "example.org."}
+	c.set(key, msg)
+
+	*now = now.Add(90 * time.Second)
+	cached, _ := c.get(key)
+	require.Nil(t, cached)
+	stale := c.getStale(key)
+	require.NotNil(t, stale)
+	require.Equal(t, uint32(30), stale.Answer[0].Header().Ttl)
+
+	*now = now.Add(30 * time.Second)
+	require.Nil(t, c.getStale(key), "response expired more than stale duration ago shouldn't be returned")
+}
+
+func TestFanout_ServeStale(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var failing atomic.Bool
+	s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		if failing.Load() {
+			msg.SetRcode(r, dns.RcodeServerFailure)
+		} else {
+			msg.SetReply(r)
+			msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 60 IN A 10.0.0.1"))
+			msg.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	f := New()
+	f.from = "."
+	f.addClient(NewClient(s.addr, udp))
+	f.cacheConfig.StaleDuration = time.Hour
+	f.cacheConfig.StaleTTL = 30 * time.Second
+	cfg := f.cacheConfig
+	cfg.Capacity = 10
+	now := time.Now()
+	f.cache = newResponseCache(cfg)
+	f.cache.now = func() time.Time { return now }
+
+	serve := func(edns bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		if edns {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err := f.ServeDNS(context.TODO(), writer, req)
+		require.NoError(t, err)
+		require.Len(t, writer.answers, 1)
+		require.Equal(t, req.Id, writer.answers[0].Id)
+		return writer.answers[0]
+	}
+	require.Equal(t, uint32(60), serve(true).Answer[0].Header().Ttl)
+
+	failing.Store(true)
+	now = now.Add(2 * time.Minute)
+	stale := serve(true)
+	require.Equal(t, dns.RcodeSuccess, stale.Rcode)
+	require.Equal(t, uint32(30), stale.Answer[0].Header().Ttl)
+	require.NotNil(t, stale.IsEdns0())
+	require.Len(t, stale.IsEdns0().Option, 1)
+	require.Equal(t, dns.ExtendedErrorCodeStaleAnswer, stale.IsEdns0().Option[0].(*dns.EDNS0_EDE).InfoCode)
+	require.Nil(t, serve(false).IsEdns0(), "the stale response to the request without EDNS shouldn't have OPT record")
+
+	now = now.Add(2 * time.Hour)
+	require.Equal(t, dns.RcodeServerFailure, serve(true).Rcode)
+}
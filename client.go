@@ -20,12 +20,15 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	ot "github.com/opentracing/opentracing-go"
 	otext "github.com/opentracing/opentracing-go/ext"
+	"github.com/pkg/errors"
 )
 
 // Client represents the proxy for remote DNS server
@@ -33,21 +36,44 @@ type Client interface {
 	Request(context.Context, *request.Request) (*dns.Msg, error)
 	Endpoint() string
 	SetTLSConfig(*tls.Config)
+	SetExpire(time.Duration)
+	SetMaxIdleConns(int)
+	SetTruncationFallback(bool)
+	SetHealthCheck(HealthCheck)
+	SetCircuitBreaker(CircuitBreaker)
+	Healthy() bool
+	Allow() bool
+	RTT() time.Duration
+	RTTQuantile(q float64) time.Duration
+	InFlight() int
+	Start()
+	Stop()
 }
 
 type client struct {
-	transport Transport
-	addr      string
-	net       string
+	transport          Transport
+	addr               string
+	net                string
+	truncationFallback bool
+	health             healthChecker
+	breaker            circuitBreaker
+	rtt                atomic.Int64
+	recentRTT          rttWindow
+	inFlight           atomic.Int32
 }
 
 // NewClient creates new client with specific addr and network
 func NewClient(addr, net string) Client {
+	return newClient(addr, net, NewTransport(addr))
+}
+
+func newClient(addr, net string, transport Transport) *client {
 	a := &client{
 		addr:      addr,
 		net:       net,
-		transport: NewTransport(addr),
+		transport: transport,
 	}
+	a.breaker.addr = addr
 	return a
 }
 
@@ -59,6 +85,103 @@ func (c *client) SetTLSConfig(cfg *tls.Config) {
 	c.transport.SetTLSConfig(cfg)
 }
 
+// SetExpire sets the duration after which an idle connection to DNS server is closed
+func (c *client) SetExpire(expire time.Duration) {
+	c.transport.SetExpire(expire)
+}
+
+// SetMaxIdleConns sets the maximum number of idle connections kept to DNS server
+func (c *client) SetMaxIdleConns(n int) {
+	c.transport.SetMaxIdleConns(n)
+}
+
+// SetTruncationFallback enables retrying over TCP when truncated response is received over UDP
+func (c *client) SetTruncationFallback(enabled bool) {
+	c.truncationFallback = enabled
+}
+
+// SetHealthCheck sets the parameters of the upstream probing started by Start
+func (c *client) SetHealthCheck(hc HealthCheck) {
+	c.health.HealthCheck = hc
+}
+
+// SetCircuitBreaker sets the parameters of the passive ejection of DNS server
+func (c *client) SetCircuitBreaker(cb CircuitBreaker) {
+	c.breaker.CircuitBreaker = cb
+}
+
+// Healthy returns false if DNS server is marked as down by health checks or ejected by circuit breaker
+func (c *client) Healthy() bool {
+	return c.health.healthy() && c.breaker.available()
+}
+
+// Allow returns true if a request can be sent to DNS server right now. Unlike Healthy,
+// it takes the single trial request of a half-open circuit breaker into account.
+func (c *client) Allow() bool {
+	return c.health.healthy() && c.breaker.allow()
+}
+
+// RTT returns exponentially weighted moving average of the request duration to DNS server. Zero means not measured yet
+func (c *client) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// RTTQuantile returns q-quantile of the last request durations to DNS server. Zero means not measured yet
+func (c *client) RTTQuantile(q float64) time.Duration {
+	return c.recentRTT.quantile(q)
+}
+
+// InFlight returns the number of requests to DNS server which are waiting for the response
+func (c *client) InFlight() int {
+	return int(c.inFlight.Load())
+}
+
+// observeRTT records the duration of the answered request
+func (c *client) observeRTT(d time.Duration) {
+	c.recentRTT.add(d)
+	c.updateRTT(d)
+}
+
+// observeCancelledRTT records the duration of the request cancelled before the response. The duration is only
+// a lower bound of the request duration, so it can't decrease the average. It is kept for the quantiles as is,
+// otherwise the slow requests cut by hedging would never be taken into account.
+func (c *client) observeCancelledRTT(d time.Duration) {
+	c.recentRTT.add(d)
+	c.updateRTT(max(d, c.RTT()))
+}
+
+// observeFailedRTT records the failed request. The upstream failing fast is not fast, so the failure counts
+// as the request timed out by the read timeout.
+func (c *client) observeFailedRTT(d time.Duration) {
+	c.updateRTT(max(d, readTimeout))
+}
+
+// updateRTT moves the average request duration towards the observed one
+func (c *client) updateRTT(d time.Duration) {
+	for {
+		avg := c.rtt.Load()
+		next := int64(d)
+		if avg != 0 {
+			next = avg + (int64(d)-avg)/rttAvgWeight
+		}
+		if c.rtt.CompareAndSwap(avg, next) {
+			return
+		}
+	}
+}
+
+// Start starts the connection pool maintenance and the health checks of client
+func (c *client) Start() {
+	c.transport.Start()
+	c.startHealthCheck()
+}
+
+// Stop stops the client and closes its idle connections
+func (c *client) Stop() {
+	c.stopHealthCheck()
+	c.transport.Stop()
+}
+
 // Endpoint returns address of DNS server
 func (c *client) Endpoint() string {
 	return c.addr
@@ -73,51 +196,104 @@ func (c *client) Request(ctx context.Context, r *request.Request) (*dns.Msg, err
 		ctx = ot.ContextWithSpan(ctx, childSpan)
 		defer childSpan.Finish()
 	}
+	c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
 	start := time.Now()
-	conn, err := c.transport.Dial(ctx, c.net)
+	ret, err := c.exchange(ctx, c.net, r)
 	if err != nil {
+		if ctx.Err() != nil {
+			c.observeCancelledRTT(time.Since(start))
+			// the timeout of the request is a failure, while the cancelled request has just lost the race
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				c.breaker.report(nil, ctx.Err())
+			}
+			return nil, err
+		}
+		c.observeFailedRTT(time.Since(start))
+		c.breaker.report(nil, err)
 		return nil, err
 	}
+	if ret.Truncated && c.truncationFallback && c.net == udp {
+		tcpRet, tcpErr := c.exchange(ctx, tcp, r)
+		if tcpErr != nil {
+			log.Debugf("TCP fallback to %s failed: %v", c.addr, tcpErr)
+		} else {
+			ret = tcpRet
+		}
+	}
+	rc, ok := dns.RcodeToString[ret.Rcode]
+	if !ok {
+		rc = fmt.Sprint(ret.Rcode)
+	}
+	c.observeRTT(time.Since(start))
+	c.breaker.report(ret, nil)
+	RequestCount.WithLabelValues(c.addr).Add(1)
+	RcodeCount.WithLabelValues(rc, c.addr).Add(1)
+	RequestDuration.WithLabelValues(c.addr).Observe(time.Since(start).Seconds())
+	return ret, nil
+}
+
+// exchange sends request over pooled connection. A cached connection might have been closed by
+// the upstream in the meantime, so then the request is retried on the next one.
+func (c *client) exchange(ctx context.Context, network string, r *request.Request) (*dns.Msg, error) {
+	for {
+		conn, cached, err := c.transport.Dial(ctx, network)
+		if err != nil {
+			return nil, err
+		}
+		ret, err := c.roundTrip(ctx, network, conn, r)
+		if cached && errors.Is(err, io.EOF) {
+			continue
+		}
+		return ret, err
+	}
+}
 
-	//Set buffer size correctly for this conn.
-	conn.UDPSize = uint16(r.Size())
-	if conn.UDPSize < 512 {
-		conn.UDPSize = 512
+func (c *client) roundTrip(ctx context.Context, network string, conn *dns.Conn, r *request.Request) (*dns.Msg, error) {
+	//Set buffer size correctly for this conn. Requests made by fanout itself have no writer.
+	conn.UDPSize = 512
+	if r.W != nil && r.Size() > 512 {
+		conn.UDPSize = uint16(r.Size())
 	}
 
-	defer func() {
-		_ = conn.Close()
-	}()
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
 	go func() {
-		<-ctx.Done()
-		_ = conn.Close()
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
 	}()
-	if err = conn.SetWriteDeadline(time.Now().Add(maxTimeout)); err != nil {
+	ret, err := readWrite(conn, r)
+	close(done)
+	if <-closed || err != nil {
+		_ = conn.Close()
+	} else {
+		c.transport.Yield(network, conn)
+	}
+	return ret, err
+}
+
+func readWrite(conn *dns.Conn, r *request.Request) (*dns.Msg, error) {
+	if err := conn.SetWriteDeadline(time.Now().Add(maxTimeout)); err != nil {
 		return nil, err
 	}
-	if err = conn.WriteMsg(r.Req); err != nil {
+	if err := conn.WriteMsg(r.Req); err != nil {
 		return nil, err
 	}
-	if err = conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+	if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
 		return nil, err
 	}
-	var ret *dns.Msg
-
 	for {
-		ret, err = conn.ReadMsg()
+		ret, err := conn.ReadMsg()
 		if err != nil {
 			return nil, err
 		}
 		if r.Req.Id == ret.Id {
-			break
+			return ret, nil
 		}
 	}
-	rc, ok := dns.RcodeToString[ret.Rcode]
-	if !ok {
-		rc = fmt.Sprint(ret.Rcode)
-	}
-	RequestCount.WithLabelValues(c.addr).Add(1)
-	RcodeCount.WithLabelValues(rc, c.addr).Add(1)
-	RequestDuration.WithLabelValues(c.addr).Observe(time.Since(start).Seconds())
-	return ret, nil
 }
@@ -2,7 +2,9 @@ package fanout
 
 import (
 	"context"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/coredns/coredns/request"
@@ -34,3 +36,83 @@ func TestUseRequestSizeOnConn(t *testing.T) {
 	require.Nil(t, err)
 	require.Len(t, d.Answer, 3)
 }
+
+func TestTruncationFallback(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			msg.Truncated = true
+		} else {
+			msg.Answer = append(msg.Answer, makeRecordA("example1. 3600	IN	A 10.0.0.1"))
+		}
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	s := newServer(udp, handler)
+	defer s.close()
+	// udp server doesn't serve its tcp listener, so serve it separately
+	started := make(chan struct{})
+	tcpServer := &dns.Server{Listener: s.inner.Listener, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		logErrIfNotNil(tcpServer.ActivateAndServe())
+	}()
+	<-started
+	defer func() {
+		logErrIfNotNil(tcpServer.Shutdown())
+	}()
+
+	for _, fallback := range []bool{false, true} {
+		c := NewClient(s.addr, udp)
+		c.SetTruncationFallback(fallback)
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		d, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.Nil(t, err)
+		require.Equal(t, !fallback, d.Truncated)
+		if fallback {
+			require.Len(t, d.Answer, 1)
+		}
+		c.Stop()
+	}
+}
+
+func TestClientRTT(t *testing.T) {
+	c := NewClient("127.0.0.1:53", udp).(*client)
+	require.Zero(t, c.RTT())
+	c.observeRTT(100 * time.Millisecond)
+	require.Equal(t, 100*time.Millisecond, c.RTT())
+	c.observeRTT(20 * time.Millisecond)
+	require.Equal(t, 80*time.Millisecond, c.RTT())
+	c.observeCancelledRTT(10 * time.Millisecond)
+	require.Equal(t, 80*time.Millisecond, c.RTT(), "cancelled request shouldn't decrease the average")
+	c.observeCancelledRTT(120 * time.Millisecond)
+	require.Equal(t, 90*time.Millisecond, c.RTT())
+	require.Equal(t, 120*time.Millisecond, c.RTTQuantile(1), "cancelled requests should be kept for the quantiles")
+}
+
+func TestClientInFlight(t *testing.T) {
+	release := make(chan struct{})
+	s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-release
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	c := NewClient(s.addr, udp)
+	require.Zero(t, c.InFlight())
+
+	done := make(chan error)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		_, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		done <- err
+	}()
+	require.Eventually(t, func() bool {
+		return c.InFlight() == 1
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+	require.NoError(t, <-done)
+	require.Zero(t, c.InFlight())
+}
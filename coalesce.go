@@ -0,0 +1,113 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+type flightKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+	// edns and size keep the requests without EDNS or with the smaller buffer from getting the response
+	// sized for another request
+	edns   bool
+	size   uint16
+	subnet string
+}
+
+type flight struct {
+	done   chan struct{}
+	result *response
+	err    error
+}
+
+// flightGroup coalesces concurrent identical requests, so only one fanout is made per question
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[flightKey]*flight)}
+}
+
+func newFlightKey(state *request.Request) flightKey {
+	key := flightKey{
+		name:   strings.ToLower(state.QName()),
+		qtype:  state.QType(),
+		qclass: state.QClass(),
+		do:     state.Do(),
+		cd:     state.Req.CheckingDisabled,
+	}
+	if opt := state.Req.IsEdns0(); opt != nil {
+		key.edns, key.size = true, opt.UDPSize()
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				key.subnet = subnet.String()
+			}
+		}
+	}
+	return key
+}
+
+// do calls fn once for all concurrent requests with the same key. fn runs independently of the requests,
+// so the cancellation of one request doesn't fail the others, and each request stops waiting when its ctx is done.
+// The requests get a copy of the response with their own ID and question.
+func (g *flightGroup) do(ctx context.Context, state *request.Request, fn func() (*response, error)) (*response, error) {
+	key := newFlightKey(state)
+	g.mu.Lock()
+	fl, ok := g.flights[key]
+	if !ok {
+		fl = &flight{done: make(chan struct{})}
+		g.flights[key] = fl
+		go g.run(key, fl, fn)
+	}
+	g.mu.Unlock()
+	if ok {
+		CoalescedCount.Add(1)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-fl.done:
+	}
+	if fl.result == nil || fl.result.response == nil {
+		return fl.result, fl.err
+	}
+	result := *fl.result
+	result.response = fl.result.response.Copy()
+	result.response.Id = state.Req.Id
+	result.response.Question = state.Req.Question
+	return &result, fl.err
+}
+
+func (g *flightGroup) run(key flightKey, fl *flight, fn func() (*response, error)) {
+	fl.result, fl.err = fn()
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(fl.done)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestFlightKey(t *testing.T) {
+	newKey := func(modify func(m *dns.Msg)) flightKey {
+		m := new(dns.Msg)
+		m.SetQuestion("Example.org.", dns.TypeA)
+		modify(m)
+		return newFlightKey(&request.Request{W: new(test.ResponseWriter), Req: m})
+	}
+	base := newKey(func(*dns.Msg) {})
+	require.Equal(t, base, newKey(func(m *dns.Msg) { m.Question[0].Name = "example.ORG." }))
+	require.NotEqual(t, base, newKey(func(m *dns.Msg) { m.Question[0].Qtype = dns.TypeAAAA }))
+	require.NotEqual(t, base, newKey(func(m *dns.Msg) { m.CheckingDisabled = true }))
+	require.NotEqual(t, base, newKey(func(m *dns.Msg) { m.SetEdns0(dns.DefaultMsgSize, true) }))
+	require.NotEqual(t, base, newKey(func(m *dns.Msg) { m.SetEdns0(dns.MinMsgSize, false) }))
+	require.NotEqual(t, newKey(func(m *dns.Msg) { m.SetEdns0(dns.MinMsgSize, false) }),
+		newKey(func(m *dns.Msg) { m.SetEdns0(dns.DefaultMsgSize, false) }))
+
+	withSubnet := func(ip string) func(m *dns.Msg) {
+		return func(m *dns.Msg) {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(ip),
+			})
+		}
+	}
+	require.Equal(t, newKey(withSubnet("10.0.0.0")), newKey(withSubnet("10.0.0.0")))
+	require.NotEqual(t, newKey(withSubnet("10.0.0.0")), newKey(withSubnet("10.0.1.0")))
+}
+
+func TestFanout_Coalescing(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	const clients = 20
+	var requests atomic.Int32
+	release := make(chan struct{})
+	s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		requests.Add(1)
+		<-release
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	f := New()
+	f.from = "."
+	f.addClient(NewClient(s.addr, udp))
+	coalesced := testutil.ToFloat64(CoalescedCount)
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(testQuery, dns.TypeA)
+			writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+			_, err := f.ServeDNS(context.TODO(), writer, req)
+			require.NoError(t, err)
+			require.Len(t, writer.answers, 1)
+			require.Equal(t, req.Id, writer.answers[0].Id)
+			require.Len(t, writer.answers[0].Answer, 1)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(CoalescedCount) == coalesced+clients-1
+	}, time.Second, 10*time.Millisecond, "all requests but one should wait for the fanout")
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), requests.Load())
+}
+
+func TestFanout_CoalescingLeaderCancelled(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var requests atomic.Int32
+	release := make(chan struct{})
+	s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		requests.Add(1)
+		<-release
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	f := New()
+	f.from = "."
+	f.addClient(NewClient(s.addr, udp))
+	coalesced := testutil.ToFloat64(CoalescedCount)
+
+	serve := func(ctx context.Context) (*cachedDNSWriter, error) {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err := f.ServeDNS(ctx, writer, req)
+		return writer, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := serve(ctx)
+		leaderErr <- err
+	}()
+	require.Eventually(t, func() bool {
+		return requests.Load() == 1
+	}, time.Second, 10*time.Millisecond, "the first request should start the fanout")
+	var writer *cachedDNSWriter
+	var waiterErr error
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		writer, waiterErr = serve(context.Background())
+	}()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(CoalescedCount) == coalesced+1
+	}, time.Second, 10*time.Millisecond, "the second request should wait for the fanout")
+
+	cancel()
+	require.ErrorIs(t, <-leaderErr, context.Canceled)
+	close(release)
+	<-waiterDone
+	require.NoError(t, waiterErr)
+	require.Len(t, writer.answers, 1)
+	require.Len(t, writer.answers[0].Answer, 1)
+	require.Equal(t, int32(1), requests.Load())
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+var errNoConsensus = errors.New("upstreams disagree")
+
+// getConsensusResult waits until consensus upstreams return equivalent answers and returns one of them.
+// If the upstreams can't reach the consensus, the result has errNoConsensus error.
+func (f *Fanout) getConsensusResult(ctx context.Context, responseCh <-chan *response) *response {
+	var result *response
+	groups := make(map[string]int)
+	for {
+		select {
+		case <-ctx.Done():
+			return noConsensus(result)
+		case r, ok := <-responseCh:
+			if !ok {
+				return noConsensus(result)
+			}
+			if f.preference.isBetter(result, r) {
+				result = r
+			}
+			if r.err != nil || r.response == nil {
+				break
+			}
+			key := answerKey(r.response)
+			groups[key]++
+			if groups[key] >= f.consensus {
+				return r
+			}
+		}
+	}
+}
+
+// noConsensus marks the successful result as failed as it isn't confirmed by enough upstreams
+func noConsensus(result *response) *response {
+	if result == nil || result.err != nil {
+		return result
+	}
+	return &response{client: result.client, start: result.start, err: errNoConsensus}
+}
+
+// answerKey returns the same key for the responses with the same rcode and answer RRsets regardless of TTL and order
+func answerKey(m *dns.Msg) string {
+	rrs := make([]string, 0, len(m.Answer))
+	for _, rr := range m.Answer {
+		rrs = append(rrs, recordKey(rr))
+	}
+	sort.Strings(rrs)
+	return strconv.Itoa(m.Rcode) + "\n" + strings.Join(rrs, "\n")
+}
+
+// noConsensusMsg creates SERVFAIL reply with extended DNS error describing the disagreement of upstreams
+func noConsensusMsg(req *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetRcode(req, dns.RcodeServerFailure)
+	if opt := req.IsEdns0(); opt != nil {
+		msg.SetEdns0(opt.UDPSize(), opt.Do())
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeOther,
+			ExtraText: errNoConsensus.Error(),
+		})
+	}
+	return msg
+}
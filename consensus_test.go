@@ -0,0 +1,114 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestAnswerKey(t *testing.T) {
+	m1 := new(dns.Msg)
+	m1.Answer = []dns.RR{test.A("example.org. 300 IN A 10.0.0.1"), test.A("example.org. 300 IN A 10.0.0.2")}
+	m2 := new(dns.Msg)
+	m2.Answer = []dns.RR{test.A("EXAMPLE.org. 20 IN A 10.0.0.2"), test.A("example.org. 10 IN A 10.0.0.1")}
+	m3 := new(dns.Msg)
+	m3.Answer = []dns.RR{test.A("example.org. 300 IN A 10.0.0.1"), test.A("example.org. 300 IN A 6.6.6.6")}
+	m4 := new(dns.Msg)
+	m4.Rcode = dns.RcodeNameError
+
+	require.Equal(t, answerKey(m1), answerKey(m2))
+	require.NotEqual(t, answerKey(m1), answerKey(m3))
+	require.NotEqual(t, answerKey(new(dns.Msg)), answerKey(m4))
+	require.Equal(t, uint32(20), m2.Answer[0].Header().Ttl, "answers shouldn't be modified")
+}
+
+type consensusTestCase struct {
+	answers       []string
+	consensus     int
+	expectedRcode int
+	expectedEDE   bool
+}
+
+func TestFanout_Consensus(t *testing.T) {
+	testCases := map[string]consensusTestCase{
+		"majority_agrees": {
+			answers:       []string{"10.0.0.1", "6.6.6.6", "10.0.0.1"},
+			consensus:     2,
+			expectedRcode: dns.RcodeSuccess,
+		},
+		"upstreams_disagree": {
+			answers:       []string{"10.0.0.1", "6.6.6.6", "10.0.0.2"},
+			consensus:     2,
+			expectedRcode: dns.RcodeServerFailure,
+			expectedEDE:   true,
+		},
+		"all_agree": {
+			answers:       []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"},
+			consensus:     3,
+			expectedRcode: dns.RcodeSuccess,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			testConsensus(t, tc)
+		})
+	}
+}
+
+func testConsensus(t *testing.T, tc consensusTestCase) {
+	defer goleak.VerifyNone(t)
+	f := New()
+	f.from = "."
+	for _, answer := range tc.answers {
+		a := answer
+		s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A "+a))
+			logErrIfNotNil(w.WriteMsg(msg))
+		})
+		defer s.close()
+		f.addClient(NewClient(s.addr, udp))
+	}
+	f.consensus = tc.consensus
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err := f.ServeDNS(context.TODO(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	resp := writer.answers[0]
+	require.Equal(t, tc.expectedRcode, resp.Rcode)
+	if tc.expectedEDE {
+		require.NotNil(t, resp.IsEdns0())
+		require.Len(t, resp.IsEdns0().Option, 1)
+		ede, ok := resp.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+		require.True(t, ok)
+		require.Equal(t, dns.ExtendedErrorCodeOther, ede.InfoCode)
+		return
+	}
+	require.Len(t, resp.Answer, 1)
+	require.Equal(t, "10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+}
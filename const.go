@@ -19,18 +19,55 @@ package fanout
 import "time"
 
 const (
-	maxIPCount           = 100
-	maxLoadFactor        = 100
-	minLoadFactor        = 1
-	policyWeightedRandom = "weighted-random"
-	policySequential     = "sequential"
-	maxWorkerCount       = 32
-	minWorkerCount       = 2
-	maxTimeout           = 2 * time.Second
-	defaultTimeout       = 30 * time.Second
-	readTimeout          = 2 * time.Second
-	attemptDelay         = time.Millisecond * 100
-	tcptls               = "tcp-tls"
-	tcp                  = "tcp"
-	udp                  = "udp"
+	maxIPCount                  = 100
+	maxLoadFactor               = 100
+	minLoadFactor               = 1
+	policyWeightedRandom        = "weighted-random"
+	policySequential            = "sequential"
+	policyFastest               = "fastest"
+	policyP2C                   = "p2c"
+	policyConsistentHash        = "consistent-hash"
+	hashKeyQName                = "qname"
+	hashKeyQNameQType           = "qname-qtype"
+	hashReplicas                = 100
+	defaultHashLoadFactor       = 1.25
+	defaultExplore              = 0.05
+	rttAvgWeight                = 4
+	rttWindowSize               = 64
+	hedgeAuto                   = "auto"
+	hedgeQuantile               = 0.95
+	defaultHedgeDelay           = 100 * time.Millisecond
+	maxWorkerCount              = 32
+	minWorkerCount              = 2
+	maxTimeout                  = 2 * time.Second
+	defaultTimeout              = 30 * time.Second
+	defaultTierTimeout          = 2 * time.Second
+	readTimeout                 = 2 * time.Second
+	attemptDelay                = time.Millisecond * 100
+	defaultExpire               = 10 * time.Second
+	defaultMaxIdleConns         = 16
+	defaultDoHPath              = "/dns-query"
+	defaultHealthCheckQuery     = "."
+	defaultHealthCheckFails     = 2
+	defaultHealthCheckSuccesses = 1
+	defaultServFailWindow       = 20
+	defaultBaseEjection         = 5 * time.Second
+	defaultMaxEjection          = 5 * time.Minute
+	defaultReloadInterval       = time.Minute
+	reloadSuccess               = "success"
+	reloadFailure               = "failure"
+	defaultCacheCapacity        = 10000
+	defaultCacheMaxTTL          = time.Hour
+	defaultCacheMaxNegativeTTL  = 30 * time.Minute
+	defaultPrefetchDuration     = time.Minute
+	defaultPrefetchPercentage   = 10
+	defaultStaleDuration        = time.Hour
+	defaultStaleTTL             = 30 * time.Second
+	qtypeActionNext             = "next"
+	qtypeActionNoData           = "nodata"
+	allDownAny                  = "any"
+	allDownServFail             = "servfail"
+	tcptls                      = "tcp-tls"
+	tcp                         = "tcp"
+	udp                         = "udp"
 )
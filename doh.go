@@ -0,0 +1,216 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const dohMediaType = "application/dns-message"
+
+// NewDoHClient creates new client sending DNS messages to addr as RFC 8484 requests
+func NewDoHClient(addr, path, method string) Client {
+	return newClient(addr, tcptls, NewDoHTransport(addr, path, method))
+}
+
+// NewDoHTransport creates new transport exchanging DNS messages over HTTPS with the server on addr
+func NewDoHTransport(addr, path, method string) Transport {
+	return &dohTransport{
+		url:          "https://" + addr + path,
+		method:       method,
+		expire:       defaultExpire,
+		maxIdleConns: defaultMaxIdleConns,
+	}
+}
+
+type dohTransport struct {
+	url          string
+	method       string
+	tlsConfig    *tls.Config
+	expire       time.Duration
+	maxIdleConns int
+	once         sync.Once
+	client       *http.Client
+}
+
+// SetTLSConfig sets tls config for transport
+func (t *dohTransport) SetTLSConfig(c *tls.Config) {
+	t.tlsConfig = c
+}
+
+// SetExpire sets the duration after which an idle HTTP connection is closed
+func (t *dohTransport) SetExpire(expire time.Duration) {
+	t.expire = expire
+}
+
+// SetMaxIdleConns sets the maximum number of idle HTTP connections
+func (t *dohTransport) SetMaxIdleConns(n int) {
+	t.maxIdleConns = n
+}
+
+// Start does nothing as idle HTTP connections are maintained by http.Transport.
+func (t *dohTransport) Start() {}
+
+// Stop closes idle HTTP connections.
+func (t *dohTransport) Stop() {
+	if t.client != nil {
+		t.client.CloseIdleConnections()
+	}
+}
+
+// Dial returns connection which sends each written DNS message as a separate HTTP request.
+// HTTP connections are pooled by http.Transport, so the returned connection is never cached.
+func (t *dohTransport) Dial(ctx context.Context, _ string) (*dns.Conn, bool, error) {
+	t.once.Do(func() {
+		t.client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:     t.tlsConfig,
+				ForceAttemptHTTP2:   true,
+				TLSHandshakeTimeout: maxTimeout,
+				IdleConnTimeout:     t.expire,
+				MaxIdleConnsPerHost: t.maxIdleConns,
+				DisableKeepAlives:   t.expire == 0 || t.maxIdleConns == 0,
+			},
+		}
+	})
+	ctx, cancel := context.WithCancel(ctx)
+	return &dns.Conn{Conn: &dohConn{ctx: ctx, cancel: cancel, t: t}}, false, nil
+}
+
+// Yield closes the connection as it is not reusable.
+func (t *dohTransport) Yield(_ string, conn *dns.Conn) {
+	_ = conn.Close()
+}
+
+func (t *dohTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var req *http.Request
+	var err error
+	if t.method == http.MethodGet {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, t.url+"?dns="+base64.RawURLEncoding.EncodeToString(query), http.NoBody)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected HTTP status from %s: %s", t.url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+}
+
+// dohConn adapts HTTP exchange to the length-prefixed stream framing used by dns.Conn.
+type dohConn struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	t        *dohTransport
+	query    []byte
+	id       uint16
+	resp     *bytes.Reader
+	deadline time.Time
+}
+
+// Write stores the query to be sent by the next Read. Message ID is set to 0 as RFC 8484 recommends.
+func (c *dohConn) Write(b []byte) (int, error) {
+	if len(b) < 4 {
+		return 0, dns.ErrShortRead
+	}
+	c.query = append([]byte(nil), b[2:]...)
+	c.id = binary.BigEndian.Uint16(c.query)
+	binary.BigEndian.PutUint16(c.query, 0)
+	c.resp = nil
+	return len(b), nil
+}
+
+// Read sends the stored query to the server and returns the length-prefixed answer.
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.resp == nil {
+		if c.query == nil {
+			return 0, io.EOF
+		}
+		ctx := c.ctx
+		if !c.deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, c.deadline)
+			defer cancel()
+		}
+		answer, err := c.t.exchange(ctx, c.query)
+		if err != nil {
+			return 0, err
+		}
+		if len(answer) < 2 {
+			return 0, dns.ErrShortRead
+		}
+		binary.BigEndian.PutUint16(answer, c.id)
+		framed := make([]byte, 2, 2+len(answer))
+		binary.BigEndian.PutUint16(framed, uint16(len(answer)))
+		c.resp = bytes.NewReader(append(framed, answer...))
+		c.query = nil
+	}
+	return c.resp.Read(b)
+}
+
+// Close cancels the ongoing HTTP request.
+func (c *dohConn) Close() error {
+	c.cancel()
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
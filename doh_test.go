@@ -0,0 +1,101 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newDoHServer(t *testing.T, h dns.HandlerFunc) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			require.Equal(t, dohMediaType, r.Header.Get("Content-Type"))
+			buf, err = io.ReadAll(r.Body)
+		}
+		require.NoError(t, err)
+		require.Equal(t, defaultDoHPath, r.URL.Path)
+		req := new(dns.Msg)
+		require.NoError(t, req.Unpack(buf))
+		require.Equal(t, uint16(0), req.Id)
+		rec := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		h(rec, req)
+		out, err := rec.answers[0].Pack()
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(out)
+	}))
+}
+
+func TestDoHClient(t *testing.T) {
+	s := newDoHServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{
+			Answer: []dns.RR{makeRecordA("example1. 3600	IN	A 10.0.0.1")},
+		}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		c := NewDoHClient(strings.TrimPrefix(s.URL, "https://"), defaultDoHPath, method)
+		c.SetTLSConfig(&tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12})
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		d, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.NoError(t, err, method)
+		require.Equal(t, req.Id, d.Id, method)
+		require.Len(t, d.Answer, 1, method)
+		c.Stop()
+	}
+}
+
+func TestDoHClient_UntrustedCertificate(t *testing.T) {
+	s := newDoHServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.Close()
+
+	c := NewDoHClient(strings.TrimPrefix(s.URL, "https://"), defaultDoHPath, http.MethodPost)
+	c.SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+	defer c.Stop()
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.Error(t, err)
+}
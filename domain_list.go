@@ -0,0 +1,264 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// domainList is the list of domains and patterns built from the names listed in the options and the files.
+// The files are checked periodically and the list is atomically replaced when they are changed.
+type domainList struct {
+	option   string
+	names    []string
+	files    []*domainFile
+	interval time.Duration
+	domain   atomic.Value
+	stop     chan struct{}
+}
+
+// domainFile is a file with line-separated list of domains
+type domainFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte
+	names   []string
+}
+
+func newDomainList(option string) *domainList {
+	l := &domainList{option: option, interval: defaultReloadInterval}
+	l.domain.Store(&domainMatcher{domain: NewDomain()})
+	return l
+}
+
+// Contains returns true if the name is a subdomain of any domain in the list or matches any pattern
+func (l *domainList) Contains(name string) bool {
+	return l.domain.Load().(*domainMatcher).Contains(name)
+}
+
+// empty returns true if neither names nor files are added to the list
+func (l *domainList) empty() bool {
+	return len(l.names) == 0 && len(l.files) == 0
+}
+
+// addNames adds the names to the list
+func (l *domainList) addNames(names []string) error {
+	for _, name := range names {
+		normalized, err := normalizePattern(name)
+		if err != nil {
+			return err
+		}
+		l.names = append(l.names, normalized)
+	}
+	l.domain.Store(l.build())
+	return nil
+}
+
+// addFile adds the domains listed in the file to the list
+func (l *domainList) addFile(path string) error {
+	file := &domainFile{path: filepath.Clean(path)}
+	if _, err := file.load(); err != nil {
+		return err
+	}
+	l.files = append(l.files, file)
+	l.domain.Store(l.build())
+	return nil
+}
+
+func (l *domainList) build() *domainMatcher {
+	m := &domainMatcher{domain: NewDomain()}
+	for _, name := range l.names {
+		m.add(name)
+	}
+	for _, file := range l.files {
+		for _, name := range file.names {
+			m.add(name)
+		}
+	}
+	return m
+}
+
+// startReload starts periodical reloading of the files
+func (l *domainList) startReload() {
+	if l.interval <= 0 || len(l.files) == 0 {
+		return
+	}
+	l.stop = make(chan struct{})
+	go l.reloadLoop(l.stop)
+}
+
+func (l *domainList) stopReload() {
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
+
+func (l *domainList) reloadLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.reload()
+		}
+	}
+}
+
+// reload reloads the changed files and replaces the list if the names are changed.
+// A file failed to reload keeps its previous names.
+func (l *domainList) reload() {
+	var added, removed int
+	for _, file := range l.files {
+		prev := file.names
+		changed, err := file.load()
+		if err != nil {
+			ReloadCount.WithLabelValues(l.option, reloadFailure).Add(1)
+			log.Warningf("failed to reload %s file %s: %v", l.option, file.path, err)
+			continue
+		}
+		if changed {
+			a, r := diffNames(prev, file.names)
+			added += a
+			removed += r
+		}
+	}
+	if added == 0 && removed == 0 {
+		return
+	}
+	l.domain.Store(l.build())
+	ReloadCount.WithLabelValues(l.option, reloadSuccess).Add(1)
+	log.Infof("%s files are reloaded: %d added, %d removed", l.option, added, removed)
+}
+
+// load reads and parses the file if it is changed since the last load. Returns true if the names are changed
+func (f *domainFile) load() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return false, nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(b)
+	if bytes.Equal(sum[:], f.sum[:]) {
+		f.modTime, f.size = info.ModTime(), info.Size()
+		return false, nil
+	}
+	names, err := parseDomainFile(f.path, b)
+	if err != nil {
+		return false, err
+	}
+	f.modTime, f.size, f.sum, f.names = info.ModTime(), info.Size(), sum, names
+	return true, nil
+}
+
+// parseDomainFile parses the file with a domain or a pattern per line. Besides the format of except option, it supports
+// comments starting with # or !, blank lines, hosts file lines "IP NAME..." and AdBlock-style lines "||NAME^".
+func parseDomainFile(path string, b []byte) ([]string, error) {
+	lines := strings.Split(string(b), "\n")
+	names := make([]string, 0, len(lines))
+	for i, line := range lines {
+		entries, err := parseDomainLine(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, i+1)
+		}
+		for _, entry := range entries {
+			normalized, err := normalizePattern(entry)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", path, i+1)
+			}
+			names = append(names, normalized)
+		}
+	}
+	return names, nil
+}
+
+// parseDomainLine returns the domains or the patterns listed in the line of the domain file
+func parseDomainLine(line string) ([]string, error) {
+	line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+		return nil, nil
+	}
+	if strings.HasPrefix(line, regexPrefix) {
+		return []string{line}, nil
+	}
+	if i := strings.Index(line, " #"); i != -1 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if i := strings.Index(line, "\t#"); i != -1 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if strings.HasPrefix(line, "@@") {
+		return nil, errors.Errorf("exception rules aren't supported: '%s'", line)
+	}
+	if strings.HasPrefix(line, "||") {
+		rule := strings.TrimPrefix(line, "||")
+		if !strings.HasSuffix(rule, "^") || strings.ContainsAny(rule[:len(rule)-1], "^$|/") {
+			return nil, errors.Errorf("unsupported AdBlock rule: '%s'", line)
+		}
+		return []string{strings.TrimSuffix(rule, "^")}, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		return fields[1:], nil
+	}
+	if len(fields) > 1 {
+		return nil, errors.Errorf("unexpected entry: '%s'", line)
+	}
+	return fields, nil
+}
+
+// diffNames returns the number of names added to and removed from prev list
+func diffNames(prev, next []string) (added, removed int) {
+	set := make(map[string]bool, len(prev))
+	for _, name := range prev {
+		set[name] = true
+	}
+	nextSet := make(map[string]bool, len(next))
+	for _, name := range next {
+		if nextSet[name] {
+			continue
+		}
+		nextSet[name] = true
+		if !set[name] {
+			added++
+		}
+	}
+	for name := range set {
+		if !nextSet[name] {
+			removed++
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestDomainList_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "except")
+	require.NoError(t, os.WriteFile(path, []byte("example1.com.\nexample2.com."), 0o600))
+
+	l := newDomainList("except")
+	require.NoError(t, l.addNames([]string{"example.org"}))
+	require.NoError(t, l.addFile(path))
+	require.True(t, l.Contains("example.org."))
+	require.True(t, l.Contains("www.example1.com."))
+	require.True(t, l.Contains("example2.com."))
+
+	require.NoError(t, os.WriteFile(path, []byte("example2.com.\nexample3.com."), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	l.reload()
+	require.True(t, l.Contains("example.org."))
+	require.False(t, l.Contains("www.example1.com."))
+	require.True(t, l.Contains("example2.com."))
+	require.True(t, l.Contains("example3.com."))
+
+	// broken file keeps the previous list
+	require.NoError(t, os.WriteFile(path, []byte("example4.com.\na:"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	l.reload()
+	require.True(t, l.Contains("example3.com."))
+	require.False(t, l.Contains("example4.com."))
+
+	require.NoError(t, os.Remove(path))
+	l.reload()
+	require.True(t, l.Contains("example3.com."))
+}
+
+func TestDomainList_ReloadLoop(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	path := filepath.Join(t.TempDir(), "except")
+	require.NoError(t, os.WriteFile(path, []byte("example1.com."), 0o600))
+
+	l := newDomainList("except")
+	l.interval = 10 * time.Millisecond
+	require.NoError(t, l.addFile(path))
+	l.startReload()
+	defer l.stopReload()
+
+	require.NoError(t, os.WriteFile(path, []byte("example2.com."), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	require.Eventually(t, func() bool {
+		return l.Contains("example2.com.") && !l.Contains("example1.com.")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDiffNames(t *testing.T) {
+	added, removed := diffNames([]string{"a.", "b.", "c."}, []string{"b.", "c.", "d.", "e.", "d."})
+	require.Equal(t, 2, added)
+	require.Equal(t, 1, removed)
+}
+
+func TestParseDomainFile(t *testing.T) {
+	content := "# blocklist\r\n" +
+		"example1.com.\r\n" +
+		"\r\n" +
+		"   example2.com   # trailing comment\n" +
+		"! AdBlock comment\n" +
+		"||ads.example3.com^\n" +
+		"0.0.0.0 tracker.example4.com tracker.example5.com\n" +
+		"127.0.0.1\tlocal.example6.com\n" +
+		"::1 example7.com\n" +
+		"*.eu.example8.com\n" +
+		"regex:^host-[0-9]+\\.example9\\.com\\.$\n"
+	names, err := parseDomainFile("blocklist", []byte(content))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"example1.com.",
+		"example2.com.",
+		"ads.example3.com.",
+		"tracker.example4.com.",
+		"tracker.example5.com.",
+		"local.example6.com.",
+		"example7.com.",
+		"*.eu.example8.com.",
+		`regex:^host-[0-9]+\.example9\.com\.$`,
+	}, names)
+}
+
+func TestParseDomainFile_Errors(t *testing.T) {
+	samples := []struct {
+		content  string
+		expected string
+	}{
+		{"example.com\nexample.org\na:\n", "blocklist:3: unable to normalize 'a:'"},
+		{"example.com example.org", "blocklist:1: unexpected entry: 'example.com example.org'"},
+		{"\n||example.com^$important", "blocklist:2: unsupported AdBlock rule"},
+		{"@@||example.com^", "blocklist:1: exception rules aren't supported"},
+		{"0.0.0.0 a:", "blocklist:1: unable to normalize 'a:'"},
+	}
+	for _, s := range samples {
+		_, err := parseDomainFile("blocklist", []byte(s.content))
+		require.Error(t, err, s.content)
+		require.Contains(t, err.Error(), s.expected)
+	}
+}
+
+func TestDomainList_MultipleFiles(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	require.NoError(t, os.WriteFile(first, []byte("example1.com.\n"), 0o600))
+	require.NoError(t, os.WriteFile(second, []byte("||example2.com^\n"), 0o600))
+
+	l := newDomainList("except")
+	require.NoError(t, l.addFile(first))
+	require.NoError(t, l.addFile(second))
+	require.True(t, l.Contains("example1.com."))
+	require.True(t, l.Contains("www.example2.com."))
+	require.False(t, l.Contains("example3.com."))
+}
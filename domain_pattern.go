@@ -0,0 +1,115 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/pkg/errors"
+)
+
+const regexPrefix = "regex:"
+
+// domainMatcher matches the names against the domains, the wildcard patterns and the regular expressions
+type domainMatcher struct {
+	domain    Domain
+	wildcards [][]string
+	regexps   []*regexp.Regexp
+}
+
+// add adds the pattern normalized by normalizePattern
+func (m *domainMatcher) add(pattern string) {
+	switch {
+	case strings.HasPrefix(pattern, regexPrefix):
+		m.regexps = append(m.regexps, regexp.MustCompile(strings.TrimPrefix(pattern, regexPrefix)))
+	case isWildcard(pattern):
+		m.wildcards = append(m.wildcards, dnsLabels(pattern))
+	default:
+		m.domain.AddString(pattern)
+	}
+}
+
+// Contains returns true if the name is a subdomain of any domain or matches any pattern.
+// The patterns are checked only if the name isn't found in the domains trie.
+func (m *domainMatcher) Contains(name string) bool {
+	if m.domain.Contains(name) {
+		return true
+	}
+	if len(m.wildcards) > 0 {
+		labels := dnsLabels(name)
+		for _, wildcard := range m.wildcards {
+			if matchWildcard(wildcard, labels) {
+				return true
+			}
+		}
+	}
+	for _, r := range m.regexps {
+		if r.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePattern normalizes the domain name or the wildcard pattern like plugin.Host does.
+// Regular expressions prefixed with "regex:" are compiled to check them and returned as is.
+func normalizePattern(s string) (string, error) {
+	if strings.HasPrefix(s, regexPrefix) {
+		if _, err := regexp.Compile(strings.TrimPrefix(s, regexPrefix)); err != nil {
+			return "", errors.Wrapf(err, "invalid regular expression '%s'", s)
+		}
+		return s, nil
+	}
+	normalized := plugin.Host(s).NormalizeExact()
+	if len(normalized) == 0 {
+		return "", errors.Errorf("unable to normalize '%s'", s)
+	}
+	if isWildcard(normalized[0]) {
+		for _, label := range dnsLabels(normalized[0]) {
+			if _, err := path.Match(label, ""); err != nil {
+				return "", errors.Errorf("invalid wildcard pattern '%s'", s)
+			}
+		}
+	}
+	return normalized[0], nil
+}
+
+func isWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// matchWildcard returns true if the trailing labels of the name match the labels of the pattern.
+// So the pattern matches the names and their subdomains the same way as the domains do.
+func matchWildcard(pattern, labels []string) bool {
+	if len(labels) < len(pattern) {
+		return false
+	}
+	labels = labels[len(labels)-len(pattern):]
+	for i := range pattern {
+		if ok, _ := path.Match(pattern[i], labels[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func dnsLabels(name string) []string {
+	return strings.Split(strings.TrimSuffix(name, "."), ".")
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainMatcher_Contains(t *testing.T) {
+	samples := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*.foo.example", "a.foo.example.", true},
+		{"*.foo.example", "b.a.foo.example.", true},
+		{"*.foo.example", "foo.example.", false},
+		{"api.*.example.", "api.eu.example.", true},
+		{"api.*.example.", "v1.api.us.example.", true},
+		{"api.*.example.", "api.example.", false},
+		{"api.*.example.", "web.eu.example.", false},
+		{"host-?.EU.example.", "host-1.eu.example.", true},
+		{"host-?.eu.example.", "host-12.eu.example.", false},
+		{`regex:^host-[0-9]+\.eu\.example\.$`, "host-12.eu.example.", true},
+		{`regex:^host-[0-9]+\.eu\.example\.$`, "a.host-12.eu.example.", false},
+		{"example.org", "www.example.org.", true},
+	}
+	for i, s := range samples {
+		normalized, err := normalizePattern(s.pattern)
+		require.NoError(t, err, i)
+		m := &domainMatcher{domain: NewDomain()}
+		m.add(normalized)
+		require.Equal(t, s.expected, m.Contains(s.name), i)
+	}
+}
+
+func TestNormalizePattern_Errors(t *testing.T) {
+	for _, pattern := range []string{"regex:host-[0-9", "host-[0-9.example.", "a:"} {
+		_, err := normalizePattern(pattern)
+		require.Error(t, err, pattern)
+	}
+}
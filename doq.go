@@ -0,0 +1,194 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	doqALPN    = "doq"
+	doqNoError = 0x0
+)
+
+// NewDoQClient creates new client sending DNS messages to addr over QUIC as RFC 9250 describes
+func NewDoQClient(addr string) Client {
+	return newClient(addr, tcptls, NewDoQTransport(addr))
+}
+
+// NewDoQTransport creates new transport opening a QUIC stream to the server on addr for each DNS message
+func NewDoQTransport(addr string) Transport {
+	return &doqTransport{
+		addr:   addr,
+		expire: defaultExpire,
+	}
+}
+
+type doqTransport struct {
+	addr      string
+	tlsConfig *tls.Config
+	expire    time.Duration
+	mu        sync.Mutex
+	conn      quic.Connection
+}
+
+// SetTLSConfig sets tls config for transport. The "doq" ALPN is always negotiated.
+func (t *doqTransport) SetTLSConfig(c *tls.Config) {
+	if c == nil {
+		c = new(tls.Config)
+	}
+	t.tlsConfig = c.Clone()
+	t.tlsConfig.NextProtos = []string{doqALPN}
+}
+
+// SetExpire sets the duration after which an idle QUIC connection is closed
+func (t *doqTransport) SetExpire(expire time.Duration) {
+	t.expire = expire
+}
+
+// SetMaxIdleConns does nothing as all queries are multiplexed over a single QUIC connection.
+func (t *doqTransport) SetMaxIdleConns(int) {}
+
+// Start does nothing as QUIC connection is established on the first request.
+func (t *doqTransport) Start() {}
+
+// Stop closes QUIC connection.
+func (t *doqTransport) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		_ = t.conn.CloseWithError(doqNoError, "")
+		t.conn = nil
+	}
+}
+
+// Dial opens new stream on the QUIC connection to the server, establishing the connection if needed.
+func (t *doqTransport) Dial(ctx context.Context, _ string) (*dns.Conn, bool, error) {
+	conn, cached, err := t.connection(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return &dns.Conn{Conn: &doqConn{stream: stream, local: conn.LocalAddr(), remote: conn.RemoteAddr()}}, cached, nil
+}
+
+// Yield closes the stream as QUIC streams are not reusable.
+func (t *doqTransport) Yield(_ string, conn *dns.Conn) {
+	_ = conn.Close()
+}
+
+func (t *doqTransport) connection(ctx context.Context) (quic.Connection, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		return t.conn, true, nil
+	}
+	if t.tlsConfig == nil {
+		t.SetTLSConfig(nil)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, maxTimeout)
+	defer cancel()
+	conn, err := quic.DialAddr(dialCtx, t.addr, t.tlsConfig, &quic.Config{MaxIdleTimeout: t.expire})
+	if err != nil {
+		return nil, false, err
+	}
+	t.conn = conn
+	return conn, false, nil
+}
+
+// doqConn adapts QUIC stream to dns.Conn. Message ID is set to 0 as RFC 9250 requires.
+type doqConn struct {
+	stream quic.Stream
+	local  net.Addr
+	remote net.Addr
+	id     uint16
+	resp   *bytes.Reader
+}
+
+// Write sends the length-prefixed query and indicates through the STREAM FIN that no further data will be sent.
+func (c *doqConn) Write(b []byte) (int, error) {
+	if len(b) < 4 {
+		return 0, dns.ErrShortRead
+	}
+	query := append([]byte(nil), b...)
+	c.id = binary.BigEndian.Uint16(query[2:])
+	binary.BigEndian.PutUint16(query[2:], 0)
+	if _, err := c.stream.Write(query); err != nil {
+		return 0, err
+	}
+	return len(b), c.stream.Close()
+}
+
+// Read returns the length-prefixed answer with the original message ID.
+func (c *doqConn) Read(b []byte) (int, error) {
+	if c.resp == nil {
+		var length uint16
+		if err := binary.Read(c.stream, binary.BigEndian, &length); err != nil {
+			return 0, err
+		}
+		if length < 2 {
+			return 0, dns.ErrShortRead
+		}
+		answer := make([]byte, 2+int(length))
+		binary.BigEndian.PutUint16(answer, length)
+		if _, err := io.ReadFull(c.stream, answer[2:]); err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(answer[2:], c.id)
+		c.resp = bytes.NewReader(answer)
+	}
+	return c.resp.Read(b)
+}
+
+// Close aborts the stream in both directions.
+func (c *doqConn) Close() error {
+	c.stream.CancelRead(doqNoError)
+	return c.stream.Close()
+}
+
+func (c *doqConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *doqConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *doqConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *doqConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *doqConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+		DNSNames:     []string{"dns.example.com"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// newDoQServer starts in-process DNS-over-QUIC server and returns its address and the pool trusting its certificate
+func newDoQServer(t *testing.T, h dns.HandlerFunc) (string, *x509.CertPool, func()) {
+	cert, pool := newTestCertificate(t)
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{doqALPN},
+		MinVersion:   tls.VersionTLS13,
+	}, nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := l.Accept(ctx)
+			if err != nil {
+				return
+			}
+			go serveDoQConn(ctx, t, conn, h)
+		}
+	}()
+	return l.Addr().String(), pool, func() {
+		cancel()
+		_ = l.Close()
+		<-done
+	}
+}
+
+func serveDoQConn(ctx context.Context, t *testing.T, conn quic.Connection, h dns.HandlerFunc) {
+	defer func() {
+		_ = conn.CloseWithError(doqNoError, "")
+	}()
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		var length uint16
+		if binary.Read(stream, binary.BigEndian, &length) != nil {
+			return
+		}
+		buf := make([]byte, length)
+		if _, err = io.ReadFull(stream, buf); err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		require.NoError(t, req.Unpack(buf))
+		require.Equal(t, uint16(0), req.Id)
+		rec := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		h(rec, req)
+		out, err := rec.answers[0].Pack()
+		require.NoError(t, err)
+		framed := make([]byte, 2, 2+len(out))
+		binary.BigEndian.PutUint16(framed, uint16(len(out)))
+		_, _ = stream.Write(append(framed, out...))
+		_ = stream.Close()
+	}
+}
+
+func TestDoQClient(t *testing.T) {
+	addr, pool, closeFn := newDoQServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := dns.Msg{
+			Answer: []dns.RR{makeRecordA("example1. 3600	IN	A 10.0.0.1")},
+		}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer closeFn()
+
+	c := NewDoQClient(addr)
+	c.SetTLSConfig(&tls.Config{RootCAs: pool, ServerName: "dns.example.com", MinVersion: tls.VersionTLS13})
+	defer c.Stop()
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		d, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.NoError(t, err)
+		require.Equal(t, req.Id, d.Id)
+		require.Len(t, d.Answer, 1)
+	}
+}
+
+func TestDoQClient_WrongServerName(t *testing.T) {
+	addr, pool, closeFn := newDoQServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer closeFn()
+
+	c := NewDoQClient(addr)
+	c.SetTLSConfig(&tls.Config{RootCAs: pool, ServerName: "dns.example.org", MinVersion: tls.VersionTLS13})
+	defer c.Stop()
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.Error(t, err)
+}
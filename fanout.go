@@ -21,6 +21,7 @@ package fanout
 import (
 	"context"
 	"crypto/tls"
+	"net/http"
 	"sync"
 	"time"
 
@@ -36,22 +37,52 @@ import (
 
 var log = clog.NewWithPlugin("fanout")
 
+var errAllDown = errors.New("all upstreams are down")
+
 // Fanout represents a plugin instance that can do async requests to list of DNS servers.
 type Fanout struct {
 	clients               []Client
 	tlsConfig             *tls.Config
-	excludeDomains        Domain
+	excludeDomains        *domainList
+	onlyDomains           *domainList
+	exceptQTypes          map[uint16]bool
+	onlyQTypes            map[uint16]bool
+	qtypeNoData           bool
 	tlsServerName         string
 	timeout               time.Duration
 	race                  bool
+	preference            *preference
+	consensus             int
+	merge                 bool
+	hedge                 bool
+	hedgeDelay            time.Duration
+	truncationFallback    bool
 	net                   string
+	dohMethod             string
 	from                  string
 	attempts              int
+	expire                time.Duration
+	maxIdleConns          int
+	healthCheck           HealthCheck
+	allDownServFail       bool
+	circuitBreaker        CircuitBreaker
 	workerCount           int
 	serverCount           int
 	loadFactor            []int
 	policyType            string
+	explore               float64
+	hashQType             bool
+	hashLoadFactor        float64
 	serverSelectionPolicy policy
+	tiers                 []*tier
+	upstreams             []*upstream
+	clientTimeouts        map[Client]time.Duration
+	routes                map[string]*Fanout
+	routeDomains          Domain
+	tierTimeout           time.Duration
+	cacheConfig           CacheConfig
+	cache                 *responseCache
+	flights               *flightGroup
 	tapPlugin             *dnstap.Dnstap
 	Next                  plugin.Handler
 }
@@ -59,11 +90,41 @@ type Fanout struct {
 // New returns reference to new Fanout plugin instance with default configs.
 func New() *Fanout {
 	return &Fanout{
-		tlsConfig:             new(tls.Config),
-		net:                   "udp",
-		attempts:              3,
-		timeout:               defaultTimeout,
-		excludeDomains:        NewDomain(),
+		tlsConfig:    new(tls.Config),
+		net:          "udp",
+		dohMethod:    http.MethodPost,
+		attempts:     3,
+		timeout:      defaultTimeout,
+		expire:       defaultExpire,
+		maxIdleConns: defaultMaxIdleConns,
+		healthCheck: HealthCheck{
+			Query:     defaultHealthCheckQuery,
+			Fails:     defaultHealthCheckFails,
+			Successes: defaultHealthCheckSuccesses,
+		},
+		circuitBreaker: CircuitBreaker{
+			Window:       defaultServFailWindow,
+			BaseEjection: defaultBaseEjection,
+			MaxEjection:  defaultMaxEjection,
+		},
+		excludeDomains: newDomainList("except"),
+		onlyDomains:    newDomainList("only"),
+		exceptQTypes:   make(map[uint16]bool),
+		onlyQTypes:     make(map[uint16]bool),
+		explore:        defaultExplore,
+		hashLoadFactor: defaultHashLoadFactor,
+		tierTimeout:    defaultTierTimeout,
+		cacheConfig: CacheConfig{
+			MaxTTL:             defaultCacheMaxTTL,
+			MaxNegativeTTL:     defaultCacheMaxNegativeTTL,
+			PrefetchDuration:   defaultPrefetchDuration,
+			PrefetchPercentage: defaultPrefetchPercentage,
+		},
+		preference:            defaultPreference(),
+		routes:                make(map[string]*Fanout),
+		clientTimeouts:        make(map[Client]time.Duration),
+		routeDomains:          NewDomain(),
+		flights:               newFlightGroup(),
 		serverSelectionPolicy: &sequentialPolicy{}, // default policy
 	}
 }
@@ -85,59 +146,121 @@ func (f *Fanout) ServeDNS(ctx context.Context, w dns.ResponseWriter, m *dns.Msg)
 	if !f.match(&req) {
 		return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, m)
 	}
-	timeoutContext, cancel := context.WithTimeout(ctx, f.timeout)
-	defer cancel()
-	result := f.getFanoutResult(timeoutContext, f.runWorkers(timeoutContext, &req))
+	if f.skipQType(req.QType()) {
+		nodata := new(dns.Msg)
+		nodata.SetReply(m)
+		logErrIfNotNil(w.WriteMsg(nodata))
+		return 0, nil
+	}
+	if r := f.route(req.Name()); r != nil {
+		return r.ServeDNS(ctx, w, m)
+	}
+	if f.cacheConfig.Capacity > 0 {
+		if cached := f.cachedReply(&req); cached != nil {
+			logErrIfNotNil(w.WriteMsg(cached))
+			return 0, nil
+		}
+	}
+	return f.serveFanout(ctx, w, &req)
+}
+
+// serveFanout answers the request with the result of the fanout to the upstreams
+func (f *Fanout) serveFanout(ctx context.Context, w dns.ResponseWriter, req *request.Request) (int, error) {
+	if f.allDownServFail && !f.hasHealthyClients() {
+		return f.serveFailure(w, req, errAllDown)
+	}
+	result, err := f.flights.do(ctx, req, func() (*response, error) {
+		timeoutContext, cancel := context.WithTimeout(context.WithoutCancel(ctx), f.timeout)
+		defer cancel()
+		return f.requestTiers(timeoutContext, req), timeoutContext.Err()
+	})
 	if result == nil {
-		return dns.RcodeServerFailure, timeoutContext.Err()
+		return f.serveFailure(w, req, err)
 	}
 	metadata.SetValueFunc(ctx, "fanout/upstream", func() string {
 		return result.client.Endpoint()
 	})
+	if errors.Is(result.err, errNoConsensus) {
+		logErrIfNotNil(w.WriteMsg(noConsensusMsg(req.Req)))
+		return 0, nil
+	}
 	if result.err != nil {
-		return dns.RcodeServerFailure, result.err
+		return f.serveFailure(w, req, result.err)
 	}
 	if f.tapPlugin != nil {
-		toDnstap(f, result.client.Endpoint(), &req, result.response, result.start)
+		toDnstap(f, result.client.Endpoint(), req, result.response, result.start)
 	}
-	if !req.Match(result.response) {
-		debug.Hexdumpf(result.response, "Wrong reply for id: %d, %s %d", result.response.Id, req.QName(), req.QType())
+	f.writeResult(w, req, result.response)
+	return 0, nil
+}
+
+// writeResult writes the response of the upstream. SERVFAIL is replaced by the stale response if there is such response
+func (f *Fanout) writeResult(w dns.ResponseWriter, req *request.Request, msg *dns.Msg) {
+	if !req.Match(msg) {
+		debug.Hexdumpf(msg, "Wrong reply for id: %d, %s %d", msg.Id, req.QName(), req.QType())
 		formerr := new(dns.Msg)
 		formerr.SetRcode(req.Req, dns.RcodeFormatError)
 		logErrIfNotNil(w.WriteMsg(formerr))
+		return
+	}
+	if msg.Rcode == dns.RcodeServerFailure && f.writeStale(w, req) {
+		return
+	}
+	if f.cache != nil {
+		f.cache.set(newCacheKey(req), msg)
+	}
+	logErrIfNotNil(w.WriteMsg(msg))
+}
+
+// serveFailure writes the stale response if there is such response, otherwise returns SERVFAIL with the error
+func (f *Fanout) serveFailure(w dns.ResponseWriter, req *request.Request, err error) (int, error) {
+	if f.writeStale(w, req) {
 		return 0, nil
 	}
-	logErrIfNotNil(w.WriteMsg(result.response))
-	return 0, nil
+	return dns.RcodeServerFailure, err
 }
 
-func (f *Fanout) runWorkers(ctx context.Context, req *request.Request) chan *response {
-	sel := f.serverSelectionPolicy.selector(f.clients)
-	workerCh := make(chan Client, f.workerCount)
-	responseCh := make(chan *response, f.serverCount)
-	go func() {
-		defer close(workerCh)
-		for i := 0; i < f.serverCount; i++ {
-			select {
-			case <-ctx.Done():
-				return
-			case workerCh <- sel.Pick():
-			}
-		}
-	}()
+// writeStale writes the stale response if serve-stale is enabled and there is such response
+func (f *Fanout) writeStale(w dns.ResponseWriter, req *request.Request) bool {
+	stale := f.staleReply(req)
+	if stale == nil {
+		return false
+	}
+	logErrIfNotNil(w.WriteMsg(stale))
+	return true
+}
+
+func (f *Fanout) runWorkers(ctx context.Context, t *tier, req *request.Request) chan *response {
+	var sel clientSelector = t.policy.selector(t.clients, req)
+	if t.hasHealthyClients() {
+		sel = &healthySelector{clientSelector: sel, fallback: t.policy.selector(t.clients, req)}
+	}
+	workerCh := make(chan Client, t.workerCount)
+	responseCh := make(chan *response, t.serverCount)
+	// failedCh receives a signal per failed upstream to request the next one without waiting for the hedge delay
+	var failedCh chan struct{}
+	if f.hedge {
+		failedCh = make(chan struct{}, t.serverCount)
+	}
+	go f.pickClients(ctx, sel, t.serverCount, workerCh, failedCh)
 
 	go func() {
 		var wg sync.WaitGroup
-		wg.Add(f.workerCount)
+		wg.Add(t.workerCount)
 
-		for i := 0; i < f.workerCount; i++ {
+		for i := 0; i < t.workerCount; i++ {
 			go func() {
 				defer wg.Done()
 				for c := range workerCh {
+					// packing the message modifies its OPT record, so each upstream is requested with its own copy
+					resp := f.processClient(ctx, c, &request.Request{W: req.W, Req: req.Req.Copy()})
+					if failedCh != nil && failed(resp) {
+						failedCh <- struct{}{}
+					}
 					select {
 					case <-ctx.Done():
 						return
-					case responseCh <- f.processClient(ctx, c, &request.Request{W: req.W, Req: req.Req}):
+					case responseCh <- resp:
 					}
 				}
 			}()
@@ -150,7 +273,35 @@ func (f *Fanout) runWorkers(ctx context.Context, req *request.Request) chan *res
 	return responseCh
 }
 
+// pickClients sends up to count picked clients to the workers. With hedging enabled each next client is picked
+// after the hedge delay of the previous one or as soon as a requested client fails.
+func (f *Fanout) pickClients(ctx context.Context, sel clientSelector, count int, workerCh chan<- Client, failedCh <-chan struct{}) {
+	defer close(workerCh)
+	var prev Client
+	for i := 0; i < count; i++ {
+		if prev != nil && failedCh != nil && !f.waitHedge(ctx, prev, failedCh) {
+			return
+		}
+		c := sel.Pick()
+		if c == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case workerCh <- c:
+		}
+		prev = c
+	}
+}
+
 func (f *Fanout) getFanoutResult(ctx context.Context, responseCh <-chan *response) *response {
+	if f.consensus > 0 {
+		return f.getConsensusResult(ctx, responseCh)
+	}
+	if f.merge {
+		return f.getMergedResult(ctx, responseCh)
+	}
 	var result *response
 	for {
 		select {
@@ -160,32 +311,90 @@ func (f *Fanout) getFanoutResult(ctx context.Context, responseCh <-chan *respons
 			if !ok {
 				return result
 			}
-			if isBetter(result, r) {
+			if f.preference.isBetter(result, r) {
 				result = r
 			}
-			if r.err != nil {
-				break
-			}
-			if f.race {
-				return r
-			}
-			if r.response.Rcode != dns.RcodeSuccess {
-				break
+			if f.preference.isFinal(r, f.race) {
+				return result
 			}
-			return r
 		}
 	}
 }
 
+// hasHealthyClients returns true if at least one client of any tier isn't marked as down by health checks
+func (f *Fanout) hasHealthyClients() bool {
+	for _, c := range f.clients {
+		if c.Healthy() {
+			return true
+		}
+	}
+	for _, t := range f.tiers {
+		if t.hasHealthyClients() {
+			return true
+		}
+	}
+	return false
+}
+
+// allClients returns clients of all tiers
+func (f *Fanout) allClients() []Client {
+	if len(f.tiers) == 0 {
+		return f.clients
+	}
+	clients := append([]Client{}, f.clients...)
+	for _, t := range f.tiers {
+		clients = append(clients, t.clients...)
+	}
+	return clients
+}
+
+// clientCount returns the number of clients including the clients of the routes.
+func (f *Fanout) clientCount() int {
+	n := len(f.allClients())
+	for _, r := range f.routes {
+		n += r.clientCount()
+	}
+	return n
+}
+
 func (f *Fanout) match(state *request.Request) bool {
 	if !plugin.Name(f.from).Matches(state.Name()) || f.excludeDomains.Contains(state.Name()) {
 		return false
 	}
-	return true
+	if !f.onlyDomains.empty() && !f.onlyDomains.Contains(state.Name()) {
+		return false
+	}
+	return f.qtypeNoData || !f.skipQType(state.QType())
+}
+
+// skipQType returns true if the requests of the type shouldn't be proxied
+func (f *Fanout) skipQType(qtype uint16) bool {
+	if f.exceptQTypes[qtype] {
+		return true
+	}
+	return len(f.onlyQTypes) > 0 && !f.onlyQTypes[qtype]
+}
+
+// route returns the fanout of the longest route zone containing the name or nil if there is no such route
+func (f *Fanout) route(name string) *Fanout {
+	if len(f.routes) == 0 || !f.routeDomains.Contains(name) {
+		return nil
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if r, ok := f.routes[name[off:]]; ok {
+			return r
+		}
+	}
+	return nil
 }
 
 func (f *Fanout) processClient(ctx context.Context, c Client, r *request.Request) *response {
 	start := time.Now()
+	if timeout, ok := f.clientTimeouts[c]; ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	var err error
 	for j := 0; j < f.attempts || f.attempts == 0; <-time.After(attemptDelay) {
 		if ctx.Err() != nil {
@@ -20,6 +20,7 @@ package fanout
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"math/rand"
 	"net"
@@ -33,6 +34,7 @@ import (
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -131,6 +133,90 @@ func TestFanout_ExceptFile(t *testing.T) {
 	}
 }
 
+func TestFanout_Only(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	file, err := os.CreateTemp(t.TempDir(), "only")
+	require.NoError(t, err)
+	_, err = file.WriteString("internal.example.")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	source := fmt.Sprintf(`fanout . %v {
+	only corp.example.
+	only-file %v
+	except secret.corp.example.
+}`, s.addr, file.Name())
+	f, err := parseFanout(caddy.NewTestController("dns", source))
+	require.NoError(t, err)
+	f.Next = test.NextHandler(dns.RcodeRefused, nil)
+
+	for name, expected := range map[string]int{
+		"www.corp.example.":        dns.RcodeSuccess,
+		"internal.example.":        dns.RcodeSuccess,
+		"secret.corp.example.":     dns.RcodeRefused,
+		"example.org.":             dns.RcodeRefused,
+		"external.example.":        dns.RcodeRefused,
+		"www.internal.example.":    dns.RcodeSuccess,
+		"www.secret.corp.example.": dns.RcodeRefused,
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rcode, err := f.ServeDNS(context.TODO(), &test.ResponseWriter{}, req)
+		require.NoError(t, err)
+		require.Equal(t, expected, rcode, name)
+	}
+}
+
+func TestFanout_QType(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+
+	testCases := map[string]struct {
+		options        string
+		qtype          uint16
+		expectedRcode  int
+		expectedAnswer int
+	}{
+		"except_next":       {options: "except-qtype AAAA ANY", qtype: dns.TypeAAAA, expectedRcode: dns.RcodeRefused},
+		"except_other_type": {options: "except-qtype AAAA ANY", qtype: dns.TypeA, expectedRcode: dns.RcodeSuccess, expectedAnswer: 1},
+		"except_nodata":     {options: "except-qtype aaaa\nqtype-action nodata", qtype: dns.TypeAAAA, expectedRcode: dns.RcodeSuccess},
+		"only_next":         {options: "only-qtype A MX", qtype: dns.TypePTR, expectedRcode: dns.RcodeRefused},
+		"only_matched":      {options: "only-qtype A MX", qtype: dns.TypeA, expectedRcode: dns.RcodeSuccess, expectedAnswer: 1},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			source := fmt.Sprintf("fanout . %v {\n%v\n}", s.addr, tc.options)
+			f, err := parseFanout(caddy.NewTestController("dns", source))
+			require.NoError(t, err)
+			f.Next = test.NextHandler(dns.RcodeRefused, nil)
+
+			req := new(dns.Msg)
+			req.SetQuestion(testQuery, tc.qtype)
+			writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+			rcode, err := f.ServeDNS(context.TODO(), writer, req)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedRcode, rcode)
+			if tc.expectedRcode == dns.RcodeSuccess {
+				require.Len(t, writer.answers, 1)
+				require.Equal(t, dns.RcodeSuccess, writer.answers[0].Rcode)
+				require.Len(t, writer.answers[0].Answer, tc.expectedAnswer)
+			}
+		})
+	}
+}
+
 func (t *fanoutTestSuite) TestConfigFromCorefile() {
 	defer goleak.VerifyNone(t.T())
 	s := newServer(t.network, func(w dns.ResponseWriter, r *dns.Msg) {
@@ -410,6 +496,290 @@ func (t *fanoutTestSuite) TestServerCount() {
 	mutex.Unlock()
 }
 
+func TestFanout_FastestPolicy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var slowCount, fastCount int32
+	slow := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&slowCount, 1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer slow.close()
+	fast := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&fastCount, 1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer fast.close()
+
+	f := New()
+	f.from = "."
+	slowClient := NewClient(slow.addr, udp).(*client)
+	slowClient.observeRTT(time.Second)
+	fastClient := NewClient(fast.addr, udp).(*client)
+	fastClient.observeRTT(time.Millisecond)
+	f.addClient(slowClient)
+	f.addClient(fastClient)
+	f.serverCount = 1
+	f.serverSelectionPolicy = &fastestPolicy{
+		//nolint:gosec // init rand with constant seed to get predefined result
+		r: rand.New(rand.NewSource(1)),
+	}
+
+	for i := 0; i < 5; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		_, err := f.ServeDNS(context.TODO(), &test.ResponseWriter{}, req)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(0), atomic.LoadInt32(&slowCount))
+	require.Equal(t, int32(5), atomic.LoadInt32(&fastCount))
+}
+
+func TestFanout_FastestPolicySlowedDown(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	slowed := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer slowed.close()
+	fast := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer fast.close()
+
+	f := New()
+	f.from = "."
+	f.timeout = 100 * time.Millisecond
+	slowedClient := NewClient(slowed.addr, udp).(*client)
+	slowedClient.observeRTT(time.Millisecond)
+	fastClient := NewClient(fast.addr, udp).(*client)
+	fastClient.observeRTT(5 * time.Millisecond)
+	f.addClient(slowedClient)
+	f.addClient(fastClient)
+	f.serverCount = 1
+	f.serverSelectionPolicy = &fastestPolicy{
+		//nolint:gosec // init rand with constant seed to get predefined result
+		r: rand.New(rand.NewSource(1)),
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err := f.ServeDNS(context.TODO(), &test.ResponseWriter{}, req)
+	require.Error(t, err, "the previously fast upstream should time out")
+	require.Eventually(t, func() bool {
+		return slowedClient.RTT() > fastClient.RTT()
+	}, time.Second, 10*time.Millisecond, "the cancelled request should increase the average")
+
+	req = new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = f.ServeDNS(context.TODO(), &test.ResponseWriter{}, req)
+	require.NoError(t, err, "the fast upstream should be requested first")
+}
+
+func TestFanout_FastestPolicyRefused(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refusedAddr := conn.LocalAddr().String()
+	require.NoError(t, conn.Close())
+	live := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer live.close()
+
+	f := New()
+	f.from = "."
+	refusedClient := NewClient(refusedAddr, udp).(*client)
+	refusedClient.observeRTT(time.Millisecond)
+	liveClient := NewClient(live.addr, udp).(*client)
+	liveClient.observeRTT(5 * time.Millisecond)
+	f.addClient(refusedClient)
+	f.addClient(liveClient)
+	f.serverCount = 1
+	f.serverSelectionPolicy = &fastestPolicy{
+		//nolint:gosec // init rand with constant seed to get predefined result
+		r: rand.New(rand.NewSource(1)),
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = f.ServeDNS(context.TODO(), &test.ResponseWriter{}, req)
+	require.Error(t, err, "the previously fast upstream should refuse the request")
+	require.Greater(t, refusedClient.RTT(), liveClient.RTT(), "the failed requests should increase the average")
+
+	req = new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	_, err = f.ServeDNS(context.TODO(), &test.ResponseWriter{}, req)
+	require.NoError(t, err, "the live upstream should be requested first")
+}
+
+func TestFanout_ConsistentHashPolicy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var mutex sync.Mutex
+	names := make(map[string]map[string]struct{})
+	var clients []Client
+	for i := 0; i < 3; i++ {
+		s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+			mutex.Lock()
+			if names[r.Question[0].Name] == nil {
+				names[r.Question[0].Name] = make(map[string]struct{})
+			}
+			names[r.Question[0].Name][w.LocalAddr().String()] = struct{}{}
+			mutex.Unlock()
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			logErrIfNotNil(w.WriteMsg(msg))
+		})
+		defer s.close()
+		clients = append(clients, NewClient(s.addr, udp))
+	}
+
+	f := New()
+	f.from = "."
+	for _, c := range clients {
+		f.addClient(c)
+	}
+	f.serverCount = 1
+	f.serverSelectionPolicy = newConsistentHashPolicy(f.clients, false, defaultHashLoadFactor)
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 10; j++ {
+			req := new(dns.Msg)
+			req.SetQuestion(fmt.Sprintf("example%d.org.", j), dns.TypeA)
+			_, err := f.ServeDNS(context.TODO(), &test.ResponseWriter{}, req)
+			require.NoError(t, err)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, names, 10)
+	for name, addrs := range names {
+		require.Len(t, addrs, 1, "name %v is sent to different upstreams", name)
+	}
+}
+
+func TestFanout_Routes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	newAnswerServer := func(answer string) *server {
+		return newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A "+answer))
+			logErrIfNotNil(w.WriteMsg(msg))
+		})
+	}
+	root := newAnswerServer("10.0.0.1")
+	defer root.close()
+	corp := newAnswerServer("10.1.0.1")
+	defer corp.close()
+	lab := newAnswerServer("10.2.0.1")
+	defer lab.close()
+
+	source := fmt.Sprintf(`fanout . %v {
+	route corp.example. %v {
+		policy fastest
+	}
+	route lab.corp.example. %v
+}`, root.addr, corp.addr, lab.addr)
+	f, err := parseFanout(caddy.NewTestController("dns", source))
+	require.NoError(t, err)
+	require.NoError(t, f.OnStartup())
+	defer func() {
+		require.NoError(t, f.OnShutdown())
+	}()
+
+	for name, expected := range map[string]string{
+		"example.org.":          "10.0.0.1",
+		"www.corp.example.":     "10.1.0.1",
+		"a.b.lab.corp.example.": "10.2.0.1",
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+		_, err = f.ServeDNS(context.TODO(), writer, req)
+		require.NoError(t, err)
+		require.Len(t, writer.answers, 1)
+		require.Len(t, writer.answers[0].Answer, 1)
+		require.Equal(t, expected, writer.answers[0].Answer[0].(*dns.A).A.String(), name)
+	}
+}
+
+func TestFanout_UpstreamTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	slow := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(time.Second)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer slow.close()
+	source := fmt.Sprintf(`fanout . {
+	attempt-count 1
+	upstream %v {
+		timeout 100ms
+	}
+}`, slow.addr)
+	f, err := parseFanout(caddy.NewTestController("dns", source))
+	require.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	start := time.Now()
+	_, err = f.ServeDNS(context.TODO(), &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}, req)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestFanout_TLSServerName(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	cert, pool := newTestCertificate(t)
+	l, err := tls.Listen(tcp, "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	started := make(chan struct{})
+	s := &dns.Server{Listener: l, Net: tcptls, NotifyStartedFunc: func() { close(started) }}
+	s.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	go func() {
+		logErrIfNotNil(s.ActivateAndServe())
+	}()
+	<-started
+	defer func() {
+		logErrIfNotNil(s.Shutdown())
+	}()
+
+	f := New()
+	f.tlsConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	f.tlsServerName = "dns.example.org"
+	addr := l.Addr().String()
+	clients := newClients(f, []string{"tls://" + addr + "#dns.example.com", "tls://" + addr})
+	for _, c := range clients {
+		c.SetExpire(0)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	resp, err := clients[0].Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+	_, err = clients[1].Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+	require.Error(t, err, "certificate shouldn't be valid for the global server name")
+}
+
 func TestFanoutUDPSuite(t *testing.T) {
 	suite.Run(t, &fanoutTestSuite{network: udp})
 }
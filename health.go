@@ -0,0 +1,116 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// HealthCheck describes how an upstream is probed. Zero Interval disables probing.
+type HealthCheck struct {
+	// Query is the name queried with NS type to probe the upstream
+	Query string
+	// Interval is the period between probes
+	Interval time.Duration
+	// Fails is the number of consecutive failed probes marking the upstream as down
+	Fails int
+	// Successes is the number of consecutive successful probes marking the upstream as up again
+	Successes int
+}
+
+// healthChecker keeps the health state of a client based on the results of probes
+type healthChecker struct {
+	HealthCheck
+	down      atomic.Bool
+	mu        sync.Mutex
+	fails     int
+	successes int
+	stop      chan struct{}
+}
+
+func (h *healthChecker) healthy() bool {
+	return !h.down.Load()
+}
+
+// report updates the health state with the result of a probe
+func (h *healthChecker) report(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.successes = 0
+		h.fails++
+		if h.fails >= h.Fails {
+			h.down.Store(true)
+		}
+		return
+	}
+	h.fails = 0
+	h.successes++
+	if h.successes >= h.Successes {
+		h.down.Store(false)
+	}
+}
+
+func (c *client) startHealthCheck() {
+	if c.health.Interval <= 0 {
+		return
+	}
+	c.health.stop = make(chan struct{})
+	go c.healthCheckLoop(c.health.stop)
+}
+
+func (c *client) stopHealthCheck() {
+	if c.health.stop != nil {
+		close(c.health.stop)
+		c.health.stop = nil
+	}
+}
+
+func (c *client) healthCheckLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.health.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := c.probe()
+			if err != nil {
+				HealthcheckFailureCount.WithLabelValues(c.addr).Add(1)
+				log.Debugf("health check of %s failed: %v", c.addr, err)
+			}
+			c.health.report(err)
+		}
+	}
+}
+
+// probe sends the health check query to the upstream. Any response means the upstream is alive.
+func (c *client) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.health.Interval)
+	defer cancel()
+	m := new(dns.Msg)
+	m.SetQuestion(c.health.Query, dns.TypeNS)
+	m.RecursionDesired = false
+	_, err := c.exchange(ctx, c.net, &request.Request{Req: m})
+	return err
+}
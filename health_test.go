@@ -0,0 +1,117 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestHealthChecker_Thresholds(t *testing.T) {
+	h := &healthChecker{HealthCheck: HealthCheck{Fails: 2, Successes: 2}}
+	require.True(t, h.healthy())
+	h.report(errors.New("timeout"))
+	require.True(t, h.healthy())
+	h.report(errors.New("timeout"))
+	require.False(t, h.healthy())
+	h.report(nil)
+	require.False(t, h.healthy())
+	h.report(errors.New("timeout"))
+	h.report(nil)
+	require.False(t, h.healthy())
+	h.report(nil)
+	require.True(t, h.healthy())
+}
+
+func TestFanout_SkipsUnhealthyUpstream(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var deadQueries int32
+	dead := newServer(udp, func(_ dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == testQuery {
+			atomic.AddInt32(&deadQueries, 1)
+		}
+	})
+	defer dead.close()
+	alive := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer alive.close()
+
+	f := New()
+	f.from = "."
+	f.attempts = 1
+	f.workerCount = 1
+	f.serverCount = 1
+	for _, addr := range []string{dead.addr, alive.addr} {
+		c := NewClient(addr, udp)
+		c.SetHealthCheck(HealthCheck{Query: ".", Interval: 50 * time.Millisecond, Fails: 1, Successes: 1})
+		f.clients = append(f.clients, c)
+	}
+	require.NoError(t, f.OnStartup())
+	defer func() {
+		require.NoError(t, f.OnShutdown())
+	}()
+	require.Eventually(t, func() bool {
+		return !f.clients[0].Healthy()
+	}, time.Second, 10*time.Millisecond)
+	require.True(t, f.clients[1].Healthy())
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err := f.ServeDNS(context.Background(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, int32(0), atomic.LoadInt32(&deadQueries))
+}
+
+func TestFanout_AllDown(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	dead := newServer(udp, func(dns.ResponseWriter, *dns.Msg) {})
+	defer dead.close()
+
+	f := New()
+	f.from = "."
+	f.attempts = 1
+	f.allDownServFail = true
+	c := NewClient(dead.addr, udp)
+	c.SetHealthCheck(HealthCheck{Query: ".", Interval: 50 * time.Millisecond, Fails: 1, Successes: 1})
+	f.addClient(c)
+	require.NoError(t, f.OnStartup())
+	defer func() {
+		require.NoError(t, f.OnShutdown())
+	}()
+	require.Eventually(t, func() bool {
+		return !c.Healthy()
+	}, time.Second, 10*time.Millisecond)
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	rcode, err := f.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	require.Equal(t, errAllDown, err)
+	require.Equal(t, dns.RcodeServerFailure, rcode)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rttWindow keeps the durations of the last requests to DNS server to compute their quantiles
+type rttWindow struct {
+	mu      sync.Mutex
+	samples [rttWindowSize]time.Duration
+	next    int
+	count   int
+}
+
+func (w *rttWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+	if w.count < len(w.samples) {
+		w.count++
+	}
+}
+
+// quantile returns q-quantile of the kept durations. Zero means no durations are kept yet
+func (w *rttWindow) quantile(q float64) time.Duration {
+	w.mu.Lock()
+	samples := make([]time.Duration, w.count)
+	copy(samples, w.samples[:w.count])
+	w.mu.Unlock()
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	idx := int(math.Ceil(q*float64(len(samples)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return samples[idx]
+}
+
+// hedgeDelayOf returns the delay before the next upstream is requested after the request is sent to c
+func (f *Fanout) hedgeDelayOf(c Client) time.Duration {
+	if f.hedgeDelay > 0 {
+		return f.hedgeDelay
+	}
+	if d := c.RTTQuantile(hedgeQuantile); d > 0 {
+		return d
+	}
+	return defaultHedgeDelay
+}
+
+// waitHedge waits for the hedge delay of c or the failure of one of already requested upstreams.
+// Returns false if ctx is done.
+func (f *Fanout) waitHedge(ctx context.Context, c Client, failedCh <-chan struct{}) bool {
+	timer := time.NewTimer(f.hedgeDelayOf(c))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-failedCh:
+		return true
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestRTTWindow_Quantile(t *testing.T) {
+	var w rttWindow
+	require.Equal(t, time.Duration(0), w.quantile(hedgeQuantile))
+	for i := 1; i <= 100; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	// only the last rttWindowSize durations are kept
+	require.Equal(t, time.Duration(100-rttWindowSize+1)*time.Millisecond, w.quantile(0))
+	require.Equal(t, 97*time.Millisecond, w.quantile(hedgeQuantile))
+	require.Equal(t, 100*time.Millisecond, w.quantile(1))
+}
+
+type hedgeTestCase struct {
+	first          func(w dns.ResponseWriter, r *dns.Msg)
+	delay          time.Duration
+	expectedRcode  int
+	expectedSecond int32
+}
+
+func TestFanout_Hedge(t *testing.T) {
+	testCases := map[string]hedgeTestCase{
+		"first_answers": {
+			first: func(w dns.ResponseWriter, r *dns.Msg) {
+				msg := new(dns.Msg)
+				msg.SetReply(r)
+				logErrIfNotNil(w.WriteMsg(msg))
+			},
+			delay:          time.Second,
+			expectedRcode:  dns.RcodeSuccess,
+			expectedSecond: 0,
+		},
+		"first_fails": {
+			first: func(w dns.ResponseWriter, r *dns.Msg) {
+				msg := new(dns.Msg)
+				msg.SetRcode(r, dns.RcodeServerFailure)
+				logErrIfNotNil(w.WriteMsg(msg))
+			},
+			delay:          time.Second,
+			expectedRcode:  dns.RcodeSuccess,
+			expectedSecond: 1,
+		},
+		"first_is_slow": {
+			first:          func(dns.ResponseWriter, *dns.Msg) {},
+			delay:          100 * time.Millisecond,
+			expectedRcode:  dns.RcodeSuccess,
+			expectedSecond: 1,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			testHedge(t, tc)
+		})
+	}
+}
+
+func testHedge(t *testing.T, tc hedgeTestCase) {
+	defer goleak.VerifyNone(t)
+	first := newServer(udp, tc.first)
+	defer first.close()
+	var secondQueries int32
+	second := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&secondQueries, 1)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer second.close()
+
+	f := New()
+	f.from = "."
+	f.attempts = 1
+	f.addClient(NewClient(first.addr, udp))
+	f.addClient(NewClient(second.addr, udp))
+	f.hedge = true
+	f.hedgeDelay = tc.delay
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	start := time.Now()
+	_, err := f.ServeDNS(context.TODO(), writer, req)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 900*time.Millisecond)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, tc.expectedRcode, writer.answers[0].Rcode)
+	require.Equal(t, tc.expectedSecond, atomic.LoadInt32(&secondQueries))
+}
+
+func TestFanout_HedgeAutoDelay(t *testing.T) {
+	f := New()
+	f.hedge = true
+	c := NewClient("127.0.0.1:53", udp).(*client)
+	require.Equal(t, defaultHedgeDelay, f.hedgeDelayOf(c))
+	for i := 1; i <= 20; i++ {
+		c.observeRTT(time.Duration(i) * time.Millisecond)
+	}
+	require.Equal(t, 19*time.Millisecond, f.hedgeDelayOf(c))
+	f.hedgeDelay = time.Second
+	require.Equal(t, time.Second, f.hedgeDelayOf(c))
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Fastest selector picks elements in ascending order of their latency. With the explore probability
+// a random element is picked instead, so the latency of slow elements gets re-measured.
+type Fastest[T any] struct {
+	values  []T
+	rtts    []time.Duration
+	explore float64
+	r       *rand.Rand
+}
+
+// NewFastestSelector inits Fastest selector by copying source values and snapshotting their latency.
+// Elements with zero latency are treated as not measured yet and picked first.
+func NewFastestSelector[T any](values []T, rtt func(T) time.Duration, explore float64, r *rand.Rand) *Fastest[T] {
+	fs := &Fastest[T]{
+		values:  make([]T, len(values)),
+		rtts:    make([]time.Duration, len(values)),
+		explore: explore,
+		r:       r,
+	}
+	copy(fs.values, values)
+	for i, v := range values {
+		fs.rtts[i] = rtt(v)
+	}
+
+	return fs
+}
+
+// Pick returns the element with the lowest latency or a random one if exploring
+func (fs *Fastest[T]) Pick() T {
+	var defaultVal T
+	if len(fs.values) == 0 {
+		return defaultVal
+	}
+
+	idx := 0
+	if fs.explore > 0 && fs.r.Float64() < fs.explore {
+		idx = fs.r.Intn(len(fs.values))
+	} else {
+		for i := 1; i < len(fs.values); i++ {
+			if fs.rtts[i] < fs.rtts[idx] {
+				idx = i
+			}
+		}
+	}
+	result := fs.values[idx]
+
+	// remove picked element and its latency keeping the order of the rest
+	fs.values = append(fs.values[:idx], fs.values[idx+1:]...)
+	fs.rtts = append(fs.rtts[:idx], fs.rtts[idx+1:]...)
+	return result
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package selector
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFastest_Pick(t *testing.T) {
+	testCases := map[string]struct {
+		values  []string
+		rtts    map[string]time.Duration
+		explore float64
+
+		picksCount int
+
+		expected []string
+	}{
+		"pick_all": {
+			values:     []string{"a", "b", "c", "d"},
+			rtts:       map[string]time.Duration{"a": 30, "b": 10, "c": 40, "d": 20},
+			picksCount: 4,
+			expected:   []string{"b", "d", "a", "c"},
+		},
+		"pick_not_measured_first": {
+			values:     []string{"a", "b", "c"},
+			rtts:       map[string]time.Duration{"a": 30, "b": 10},
+			picksCount: 2,
+			expected:   []string{"c", "b"},
+		},
+		"pick_same_latency_in_order": {
+			values:     []string{"a", "b", "c"},
+			rtts:       map[string]time.Duration{"a": 10, "b": 10, "c": 10},
+			picksCount: 3,
+			expected:   []string{"a", "b", "c"},
+		},
+		"pick_always_exploring": {
+			values:     []string{"a", "b", "c", "d"},
+			rtts:       map[string]time.Duration{"a": 30, "b": 10, "c": 40, "d": 20},
+			explore:    1,
+			picksCount: 4,
+			expected:   []string{"d", "c", "a", "b"},
+		},
+		"pick_more_than_available": {
+			values:     []string{"a", "b"},
+			rtts:       map[string]time.Duration{"a": 20, "b": 10},
+			picksCount: 3,
+			expected:   []string{"b", "a", ""},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			//nolint:gosec // init rand with constant seed to get predefined result
+			r := rand.New(rand.NewSource(1))
+
+			fs := NewFastestSelector(tc.values, func(v string) time.Duration { return tc.rtts[v] }, tc.explore, r)
+
+			actual := make([]string, 0, tc.picksCount)
+			for i := 0; i < tc.picksCount; i++ {
+				actual = append(actual, fs.Pick())
+			}
+
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// HashRing places elements on a consistent hash ring. Each element owns a number of virtual nodes (replicas)
+type HashRing[T any] struct {
+	values []T
+	points []uint64
+	owners []int
+}
+
+// NewHashRing inits HashRing by placing replicas of each value at the hash of its name
+func NewHashRing[T any](values []T, name func(T) string, replicas int) *HashRing[T] {
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	points := make([]point, 0, len(values)*replicas)
+	for i, v := range values {
+		for j := 0; j < replicas; j++ {
+			points = append(points, point{hash: hashKey(name(v) + "#" + strconv.Itoa(j)), owner: i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	ring := &HashRing[T]{
+		values: make([]T, len(values)),
+		points: make([]uint64, len(points)),
+		owners: make([]int, len(points)),
+	}
+	copy(ring.values, values)
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.owners[i] = p.owner
+	}
+	return ring
+}
+
+// Selector creates ConsistentHash selector walking the ring clockwise starting from the key position.
+// If loadFactor is positive, elements loaded more than loadFactor times the average are picked last
+func (ring *HashRing[T]) Selector(key string, load func(T) int, loadFactor float64) *ConsistentHash[T] {
+	h := hashKey(key)
+	start := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i] >= h
+	})
+	return &ConsistentHash[T]{
+		ring:       ring,
+		start:      start,
+		picked:     make([]bool, len(ring.values)),
+		load:       load,
+		loadFactor: loadFactor,
+	}
+}
+
+// ConsistentHash selector picks distinct elements in the order their nodes follow the key on the hash ring
+type ConsistentHash[T any] struct {
+	ring       *HashRing[T]
+	start      int
+	picked     []bool
+	count      int
+	load       func(T) int
+	loadFactor float64
+}
+
+// Pick returns next element on the ring which isn't picked yet and isn't overloaded if any exists
+func (ch *ConsistentHash[T]) Pick() T {
+	var defaultVal T
+	if ch.count == len(ch.ring.values) {
+		return defaultVal
+	}
+
+	capacity := ch.capacity()
+	fallback := -1
+	for i := 0; i < len(ch.ring.points); i++ {
+		owner := ch.ring.owners[(ch.start+i)%len(ch.ring.points)]
+		if ch.picked[owner] {
+			continue
+		}
+		if capacity < 0 || ch.load(ch.ring.values[owner])+1 <= capacity {
+			return ch.pick(owner)
+		}
+		if fallback == -1 {
+			fallback = owner
+		}
+	}
+	return ch.pick(fallback)
+}
+
+func (ch *ConsistentHash[T]) pick(idx int) T {
+	ch.picked[idx] = true
+	ch.count++
+	return ch.ring.values[idx]
+}
+
+// capacity returns the bounded load of an element or -1 if the load isn't bounded
+func (ch *ConsistentHash[T]) capacity() int {
+	if ch.loadFactor <= 0 || ch.load == nil {
+		return -1
+	}
+	total := 1
+	for _, v := range ch.ring.values {
+		total += ch.load(v)
+	}
+	return int(math.Ceil(ch.loadFactor * float64(total) / float64(len(ch.ring.values))))
+}
+
+// hashKey returns FNV-1a hash of the key. FNV-1a poorly mixes high bits of similar keys,
+// so the result is passed through the murmur3 finalizer to spread the keys over the whole ring
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package selector
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func identity(v string) string {
+	return v
+}
+
+func pickAll(s *ConsistentHash[string], count int) []string {
+	actual := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		actual = append(actual, s.Pick())
+	}
+	return actual
+}
+
+func TestConsistentHash_Pick(t *testing.T) {
+	values := []string{"a", "b", "c", "d"}
+	ring := NewHashRing(values, identity, 100)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("example%d.org.", i)
+		first := pickAll(ring.Selector(key, nil, 0), len(values)+1)
+		second := pickAll(ring.Selector(key, nil, 0), len(values)+1)
+
+		require.Equal(t, first, second, "the same key should be mapped to the same values")
+		require.ElementsMatch(t, append(append([]string{}, values...), ""), first)
+	}
+}
+
+func TestConsistentHash_Distribution(t *testing.T) {
+	values := []string{"a", "b", "c", "d"}
+	ring := NewHashRing(values, identity, 100)
+
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[ring.Selector(fmt.Sprintf("example%d.org.", i), nil, 0).Pick()]++
+	}
+	for _, v := range values {
+		assert.InDelta(t, 1000, counts[v], 300, "value %v is picked %v times", v, counts[v])
+	}
+}
+
+func TestConsistentHash_RemoveValue(t *testing.T) {
+	ring := NewHashRing([]string{"a", "b", "c", "d"}, identity, 100)
+	reduced := NewHashRing([]string{"a", "b", "c"}, identity, 100)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("example%d.org.", i)
+		expected := ring.Selector(key, nil, 0).Pick()
+		if expected == "d" {
+			continue
+		}
+		require.Equal(t, expected, reduced.Selector(key, nil, 0).Pick(), "only keys of the removed value should be remapped")
+	}
+}
+
+func TestConsistentHash_BoundedLoad(t *testing.T) {
+	values := []string{"a", "b", "c", "d"}
+	ring := NewHashRing(values, identity, 100)
+
+	key := "example.org."
+	order := pickAll(ring.Selector(key, nil, 0), len(values))
+
+	loads := map[string]int{order[0]: 10}
+	load := func(v string) int { return loads[v] }
+
+	actual := pickAll(ring.Selector(key, load, 1.25), len(values)+1)
+	require.Equal(t, append(append([]string{}, order[1:]...), order[0], ""), actual, "overloaded value should be picked last")
+
+	actual = pickAll(ring.Selector(key, load, 0), len(values))
+	require.Equal(t, order, actual, "load shouldn't be considered if it isn't bounded")
+}
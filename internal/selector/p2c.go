@@ -0,0 +1,67 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"math/rand"
+)
+
+// P2C selector implements the power of two choices: it takes two random elements and picks the less loaded one
+type P2C[T any] struct {
+	values []T
+	load   func(T) int
+	r      *rand.Rand
+}
+
+// NewP2CSelector inits P2C selector by copying source values. The load of elements is evaluated on each pick
+func NewP2CSelector[T any](values []T, load func(T) int, r *rand.Rand) *P2C[T] {
+	ps := &P2C[T]{
+		values: make([]T, len(values)),
+		load:   load,
+		r:      r,
+	}
+	// copy the underlying array values as we're going to modify content of slices
+	copy(ps.values, values)
+
+	return ps
+}
+
+// Pick returns the less loaded of two randomly chosen elements if any exists
+func (ps *P2C[T]) Pick() T {
+	var defaultVal T
+	if len(ps.values) == 0 {
+		return defaultVal
+	}
+
+	idx := 0
+	if len(ps.values) > 1 {
+		idx = ps.r.Intn(len(ps.values))
+		other := ps.r.Intn(len(ps.values) - 1)
+		if other >= idx {
+			other++
+		}
+		if ps.load(ps.values[other]) < ps.load(ps.values[idx]) {
+			idx = other
+		}
+	}
+	result := ps.values[idx]
+
+	// remove picked element
+	ps.values[idx] = ps.values[len(ps.values)-1]
+	ps.values = ps.values[:len(ps.values)-1]
+	return result
+}
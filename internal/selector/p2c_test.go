@@ -0,0 +1,84 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package selector
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestP2C_Pick(t *testing.T) {
+	testCases := map[string]struct {
+		values []string
+		loads  map[string]int
+
+		picksCount int
+
+		expected []string
+	}{
+		"pick_all_same_load": {
+			values:     []string{"a", "b", "c", "d"},
+			loads:      map[string]int{},
+			picksCount: 4,
+			expected:   []string{"b", "c", "d", "a"},
+		},
+		"pick_less_loaded": {
+			values:     []string{"a", "b", "c", "d"},
+			loads:      map[string]int{"a": 1, "b": 5, "c": 2, "d": 0},
+			picksCount: 4,
+			expected:   []string{"a", "c", "d", "b"},
+		},
+		"pick_single": {
+			values:     []string{"a"},
+			loads:      map[string]int{"a": 10},
+			picksCount: 1,
+			expected:   []string{"a"},
+		},
+		"pick_more_than_available": {
+			values:     []string{"a", "b"},
+			loads:      map[string]int{"a": 2, "b": 1},
+			picksCount: 3,
+			expected:   []string{"b", "a", ""},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			//nolint:gosec // init rand with constant seed to get predefined result
+			r := rand.New(rand.NewSource(1))
+
+			ps := NewP2CSelector(tc.values, func(v string) int { return tc.loads[v] }, r)
+
+			actual := make([]string, 0, tc.picksCount)
+			for i := 0; i < tc.picksCount; i++ {
+				actual = append(actual, ps.Pick())
+			}
+
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestP2C_NeverPicksMostLoadedFirst(t *testing.T) {
+	//nolint:gosec // init rand with constant seed to get predefined result
+	r := rand.New(rand.NewSource(1))
+	loads := map[string]int{"a": 1, "b": 2, "c": 3}
+	for i := 0; i < 100; i++ {
+		ps := NewP2CSelector([]string{"a", "b", "c"}, func(v string) int { return loads[v] }, r)
+		assert.NotEqual(t, "c", ps.Pick())
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// getMergedResult waits for the responses of all requested upstreams and merges the answers of NOERROR responses.
+// If there are no NOERROR responses, the best result is returned.
+func (f *Fanout) getMergedResult(ctx context.Context, responseCh <-chan *response) *response {
+	var result *response
+	var merged []*response
+	for {
+		select {
+		case <-ctx.Done():
+			return mergeResponses(result, merged)
+		case r, ok := <-responseCh:
+			if !ok {
+				return mergeResponses(result, merged)
+			}
+			if f.preference.isBetter(result, r) {
+				result = r
+			}
+			if r.err == nil && r.response != nil && r.response.Rcode == dns.RcodeSuccess {
+				merged = append(merged, r)
+			}
+		}
+	}
+}
+
+// mergeResponses unions the answers of the responses removing duplicates.
+// All records of the same RRset get the minimal TTL of the RRset.
+func mergeResponses(result *response, responses []*response) *response {
+	if len(responses) < 2 {
+		if len(responses) == 1 {
+			return responses[0]
+		}
+		return result
+	}
+	msg := responses[0].response.Copy()
+	msg.Answer = nil
+	seen := make(map[string]bool)
+	minTTL := make(map[string]uint32)
+	for _, r := range responses {
+		for _, rr := range r.response.Answer {
+			set := rrsetKey(rr)
+			if ttl, ok := minTTL[set]; !ok || rr.Header().Ttl < ttl {
+				minTTL[set] = rr.Header().Ttl
+			}
+			key := recordKey(rr)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			msg.Answer = append(msg.Answer, dns.Copy(rr))
+		}
+	}
+	for _, rr := range msg.Answer {
+		rr.Header().Ttl = minTTL[rrsetKey(rr)]
+	}
+	return &response{client: responses[0].client, response: msg, start: responses[0].start}
+}
+
+// rrsetKey returns the same key for the records of the same RRset
+func rrsetKey(rr dns.RR) string {
+	h := rr.Header()
+	return strings.ToLower(h.Name) + "/" + dns.ClassToString[h.Class] + "/" + dns.TypeToString[h.Rrtype]
+}
+
+// recordKey returns the same key for the same records regardless of their TTL
+func recordKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	return rr.String()
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestMergeResponses(t *testing.T) {
+	m1 := new(dns.Msg)
+	m1.Answer = []dns.RR{test.A("example.org. 300 IN A 10.0.0.1"), test.A("example.org. 300 IN A 10.0.0.2")}
+	m2 := new(dns.Msg)
+	m2.Answer = []dns.RR{test.A("EXAMPLE.org. 60 IN A 10.0.0.2"), test.A("example.org. 60 IN A 10.0.0.3"), test.AAAA("example.org. 600 IN AAAA ::1")}
+
+	merged := mergeResponses(nil, []*response{{response: m1}, {response: m2}})
+	require.NotNil(t, merged)
+	expected := []dns.RR{
+		test.A("example.org. 60 IN A 10.0.0.1"),
+		test.A("example.org. 60 IN A 10.0.0.2"),
+		test.A("example.org. 60 IN A 10.0.0.3"),
+		test.AAAA("example.org. 600 IN AAAA ::1"),
+	}
+	require.Equal(t, len(expected), len(merged.response.Answer))
+	for i := range expected {
+		require.Equal(t, expected[i].String(), merged.response.Answer[i].String())
+	}
+	require.Equal(t, uint32(300), m1.Answer[0].Header().Ttl, "responses shouldn't be modified")
+
+	failure := &response{err: errors.New("timeout")}
+	require.Equal(t, failure, mergeResponses(failure, nil))
+}
+
+func TestFanout_Merge(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	f := New()
+	f.from = "."
+	f.merge = true
+	for _, answer := range []string{"10.0.0.1", "10.0.0.2"} {
+		a := answer
+		s := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A "+a))
+			logErrIfNotNil(w.WriteMsg(msg))
+		})
+		defer s.close()
+		f.addClient(NewClient(s.addr, udp))
+	}
+	failing := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer failing.close()
+	f.addClient(NewClient(failing.addr, udp))
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err := f.ServeDNS(context.TODO(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, dns.RcodeSuccess, writer.answers[0].Rcode)
+	var addrs []string
+	for _, rr := range writer.answers[0].Answer {
+		addrs = append(addrs, rr.(*dns.A).A.String())
+	}
+	require.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, addrs)
+}
@@ -43,4 +43,58 @@ var (
 		Buckets:   plugin.TimeBuckets,
 		Help:      "Histogram of the time each request took.",
 	}, []string{"to"})
+	HealthcheckFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "fanout",
+		Name:      "healthcheck_failures_total",
+		Help:      "Counter of the number of failed health checks per upstream.",
+	}, []string{"to"})
+	CircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "fanout",
+		Name:      "circuit_breaker_state",
+		Help:      "Gauge of the circuit breaker state per upstream: 0 - closed, 1 - open (ejected), 2 - half-open.",
+	}, []string{"to"})
+	UpstreamEjectionDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "fanout",
+		Name:      "upstream_ejection_duration_seconds",
+		Help:      "Gauge of the current ejection period per upstream, 0 if the upstream isn't ejected.",
+	}, []string{"to"})
+	ReloadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "fanout",
+		Name:      "file_reload_count_total",
+		Help:      "Counter of domain list file reloads per option and status: success or failure.",
+	}, []string{"option", "status"})
+	CacheHitCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "fanout",
+		Name:      "cache_hits_total",
+		Help:      "Counter of requests answered from the cache.",
+	})
+	CacheMissCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "fanout",
+		Name:      "cache_misses_total",
+		Help:      "Counter of requests not found in the cache.",
+	})
+	CachePrefetchCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "fanout",
+		Name:      "cache_prefetch_total",
+		Help:      "Counter of cached responses refreshed by prefetch.",
+	})
+	CacheStaleCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "fanout",
+		Name:      "cache_stale_total",
+		Help:      "Counter of stale responses served when upstreams fail.",
+	})
+	CoalescedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "fanout",
+		Name:      "coalesced_requests_total",
+		Help:      "Counter of requests answered by the fanout of a concurrent identical request.",
+	})
 )
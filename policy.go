@@ -18,12 +18,18 @@ package fanout
 
 import (
 	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
 
 	"github.com/networkservicemesh/fanout/internal/selector"
 )
 
 type policy interface {
-	selector(clients []Client) clientSelector
+	selector(clients []Client, req *request.Request) clientSelector
 }
 
 type clientSelector interface {
@@ -35,7 +41,7 @@ type sequentialPolicy struct {
 }
 
 // creates new sequential selector of provided clients
-func (p *sequentialPolicy) selector(clients []Client) clientSelector {
+func (p *sequentialPolicy) selector(clients []Client, _ *request.Request) clientSelector {
 	return selector.NewSequentialSelector(clients)
 }
 
@@ -46,6 +52,109 @@ type weightedPolicy struct {
 }
 
 // creates new weighted random selector of provided clients based on loadFactor
-func (p *weightedPolicy) selector(clients []Client) clientSelector {
+func (p *weightedPolicy) selector(clients []Client, _ *request.Request) clientSelector {
 	return selector.NewWeightedRandSelector(clients, p.loadFactor, p.r)
 }
+
+// fastestPolicy is used to select clients in ascending order of their RTT with some exploration
+type fastestPolicy struct {
+	explore float64
+	r       *rand.Rand
+}
+
+// creates new fastest selector of provided clients based on their current RTT
+func (p *fastestPolicy) selector(clients []Client, _ *request.Request) clientSelector {
+	return selector.NewFastestSelector(clients, Client.RTT, p.explore, p.r)
+}
+
+// p2cPolicy is used to select the less loaded of two random clients
+type p2cPolicy struct {
+	r *rand.Rand
+}
+
+// creates new power of two choices selector of provided clients based on their in-flight requests
+func (p *p2cPolicy) selector(clients []Client, _ *request.Request) clientSelector {
+	return selector.NewP2CSelector(clients, Client.InFlight, p.r)
+}
+
+// consistentHashPolicy is used to select clients following the request key on the hash ring of clients
+type consistentHashPolicy struct {
+	ring       *selector.HashRing[Client]
+	withQType  bool
+	loadFactor float64
+}
+
+// creates new consistent hash policy with a hash ring of provided clients
+func newConsistentHashPolicy(clients []Client, withQType bool, loadFactor float64) *consistentHashPolicy {
+	return &consistentHashPolicy{
+		ring:       selector.NewHashRing(clients, Client.Endpoint, hashReplicas),
+		withQType:  withQType,
+		loadFactor: loadFactor,
+	}
+}
+
+// creates new consistent hash selector walking the ring from the query name (and type) position.
+// Clients are placed on the ring once, so the provided clients should be the same as in newConsistentHashPolicy
+func (p *consistentHashPolicy) selector(_ []Client, req *request.Request) clientSelector {
+	return p.ring.Selector(p.key(req), Client.InFlight, p.loadFactor)
+}
+
+func (p *consistentHashPolicy) key(req *request.Request) string {
+	key := strings.ToLower(req.Name())
+	if p.withQType {
+		key += "/" + dns.TypeToString[req.QType()]
+	}
+	return key
+}
+
+// lockedSource makes rand.Source safe for concurrent use as the policies are shared between requests
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func newLockedRand() *rand.Rand {
+	//nolint:gosec // it's overhead to use crypto/rand here
+	return rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// healthySelector skips clients which are marked as down by health checks or ejected by circuit breaker
+type healthySelector struct {
+	clientSelector
+	// fallback picks from all clients if none of them can be requested right now
+	fallback clientSelector
+	picked   bool
+	all      bool
+}
+
+// Pick returns next available client picked by the underlying selector. If there is no available client
+// for the request, e.g. the only half-open client is busy with the trial request, the clients are picked
+// by the fallback selector as if they all were up.
+func (s *healthySelector) Pick() Client {
+	if s.all {
+		return s.fallback.Pick()
+	}
+	for c := s.clientSelector.Pick(); c != nil; c = s.clientSelector.Pick() {
+		if c.Allow() {
+			s.picked = true
+			return c
+		}
+	}
+	if s.picked || s.fallback == nil {
+		return nil
+	}
+	s.all = true
+	return s.fallback.Pick()
+}
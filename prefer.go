@@ -0,0 +1,138 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"github.com/miekg/dns"
+)
+
+// response classes used to rank the responses of upstreams
+const (
+	classAnswer   = "answer"
+	classNoData   = "nodata"
+	classNXDomain = "nxdomain"
+	classServFail = "servfail"
+	classOther    = "other"
+)
+
+// properties of responses used to rank the responses of the same class
+const (
+	tiebreakAD   = "ad"
+	tiebreakNoTC = "no-tc"
+)
+
+// preference ranks the responses of upstreams and defines the responses finishing the fanout
+type preference struct {
+	// ranks maps response class to its rank. The lower rank is the better one
+	ranks map[string]int
+	// defaultRank is the rank of the classes missing in ranks
+	defaultRank int
+	// tiebreaks are the properties ranking the responses of the same class in order of their importance
+	tiebreaks []string
+	// finish is the classes finishing the fanout. If nil, the best ranked classes finish the fanout
+	finish map[string]bool
+}
+
+// defaultPreference prefers NOERROR responses to the other ones and finishes the fanout on NOERROR response
+func defaultPreference() *preference {
+	return &preference{
+		ranks:       map[string]int{classAnswer: 0, classNoData: 0},
+		defaultRank: 1,
+	}
+}
+
+// classify returns the class of the response
+func classify(m *dns.Msg) string {
+	switch m.Rcode {
+	case dns.RcodeSuccess:
+		if len(m.Answer) > 0 {
+			return classAnswer
+		}
+		return classNoData
+	case dns.RcodeNameError:
+		return classNXDomain
+	case dns.RcodeServerFailure:
+		return classServFail
+	default:
+		return classOther
+	}
+}
+
+func (p *preference) rank(m *dns.Msg) int {
+	if r, ok := p.ranks[classify(m)]; ok {
+		return r
+	}
+	return p.defaultRank
+}
+
+// isBetter returns true if the right response is strictly better than the left one.
+// Errors are worse than any response.
+func (p *preference) isBetter(left, right *response) bool {
+	if right == nil {
+		return false
+	}
+	if left == nil {
+		return true
+	}
+	if right.err != nil {
+		return false
+	}
+	if left.err != nil {
+		return true
+	}
+	if right.response == nil {
+		return false
+	}
+	if left.response == nil {
+		return true
+	}
+	if l, r := p.rank(left.response), p.rank(right.response); l != r {
+		return r < l
+	}
+	for _, tiebreak := range p.tiebreaks {
+		if l, r := hasProperty(left.response, tiebreak), hasProperty(right.response, tiebreak); l != r {
+			return r
+		}
+	}
+	return false
+}
+
+// isFinal returns true if the response finishes the fanout. With race any response finishes the fanout
+// unless the finishing classes are configured explicitly.
+func (p *preference) isFinal(r *response, race bool) bool {
+	if r.err != nil || r.response == nil {
+		return false
+	}
+	if p.finish != nil {
+		return p.finish[classify(r.response)]
+	}
+	if race {
+		return true
+	}
+	return p.rank(r.response) == 0
+}
+
+func hasProperty(m *dns.Msg, property string) bool {
+	switch property {
+	case tiebreakAD:
+		return m.AuthenticatedData
+	case tiebreakNoTC:
+		return !m.Truncated
+	default:
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func msgResponse(rcode int, answers int, ad, tc bool) *response {
+	m := new(dns.Msg)
+	m.Rcode = rcode
+	m.AuthenticatedData = ad
+	m.Truncated = tc
+	for i := 0; i < answers; i++ {
+		m.Answer = append(m.Answer, test.A("example.org. 300 IN A 10.0.0.1"))
+	}
+	return &response{response: m}
+}
+
+func TestPreference_IsBetter(t *testing.T) {
+	answer := msgResponse(dns.RcodeSuccess, 1, false, false)
+	nodata := msgResponse(dns.RcodeSuccess, 0, false, false)
+	nxdomain := msgResponse(dns.RcodeNameError, 0, false, false)
+	servfail := msgResponse(dns.RcodeServerFailure, 0, false, false)
+	failure := &response{err: errors.New("timeout")}
+
+	configured := &preference{
+		ranks:       map[string]int{classAnswer: 0, classNXDomain: 1, classNoData: 2, classServFail: 3},
+		defaultRank: 4,
+		tiebreaks:   []string{tiebreakAD, tiebreakNoTC},
+	}
+
+	testCases := map[string]struct {
+		p           *preference
+		left, right *response
+		expected    bool
+	}{
+		"default_nil":                  {p: defaultPreference(), left: nil, right: servfail, expected: true},
+		"default_error":                {p: defaultPreference(), left: servfail, right: failure, expected: false},
+		"default_noerror_beats_other":  {p: defaultPreference(), left: nxdomain, right: nodata, expected: true},
+		"default_noerror_are_equal":    {p: defaultPreference(), left: nodata, right: answer, expected: false},
+		"default_others_are_equal":     {p: defaultPreference(), left: servfail, right: nxdomain, expected: false},
+		"answer_beats_nodata":          {p: configured, left: nodata, right: answer, expected: true},
+		"nxdomain_beats_nodata":        {p: configured, left: nodata, right: nxdomain, expected: true},
+		"nodata_loses_to_nxdomain":     {p: configured, left: nxdomain, right: nodata, expected: false},
+		"ad_beats_no_ad":               {p: configured, left: answer, right: msgResponse(dns.RcodeSuccess, 1, true, false), expected: true},
+		"ad_is_more_important_than_tc": {p: configured, left: msgResponse(dns.RcodeSuccess, 1, true, true), right: answer, expected: false},
+		"non_truncated_beats_tc":       {p: configured, left: msgResponse(dns.RcodeSuccess, 1, false, true), right: answer, expected: true},
+		"other_is_the_worst":           {p: configured, left: msgResponse(dns.RcodeRefused, 0, false, false), right: servfail, expected: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.p.isBetter(tc.left, tc.right))
+		})
+	}
+}
+
+func TestPreference_IsFinal(t *testing.T) {
+	answer := msgResponse(dns.RcodeSuccess, 1, false, false)
+	nodata := msgResponse(dns.RcodeSuccess, 0, false, false)
+	nxdomain := msgResponse(dns.RcodeNameError, 0, false, false)
+	failure := &response{err: errors.New("timeout")}
+
+	p := defaultPreference()
+	require.True(t, p.isFinal(answer, false))
+	require.True(t, p.isFinal(nodata, false))
+	require.False(t, p.isFinal(nxdomain, false))
+	require.True(t, p.isFinal(nxdomain, true))
+	require.False(t, p.isFinal(failure, true))
+
+	p = &preference{ranks: map[string]int{classAnswer: 0, classNoData: 1}, defaultRank: 2}
+	require.True(t, p.isFinal(answer, false))
+	require.False(t, p.isFinal(nodata, false))
+
+	p.finish = map[string]bool{classAnswer: true, classNXDomain: true}
+	require.True(t, p.isFinal(nxdomain, false))
+	require.False(t, p.isFinal(nodata, true))
+}
+
+func TestFanout_PreferAnswerToNoData(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	nodata := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer nodata.close()
+	answer := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer answer.close()
+
+	c := caddy.NewTestController("dns", "fanout . "+nodata.addr+" "+answer.addr+" {\nprefer answer nxdomain nodata servfail\n}")
+	f, err := parseFanout(c)
+	require.NoError(t, err)
+	require.NoError(t, f.OnStartup())
+	defer func() {
+		require.NoError(t, f.OnShutdown())
+	}()
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err = f.ServeDNS(context.TODO(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Len(t, writer.answers[0].Answer, 1)
+}
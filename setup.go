@@ -19,9 +19,8 @@
 package fanout
 
 import (
-	"math/rand"
-	"os"
-	"path/filepath"
+	cryptotls "crypto/tls"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -34,10 +33,12 @@ import (
 	"github.com/coredns/coredns/plugin/pkg/parse"
 	"github.com/coredns/coredns/plugin/pkg/tls"
 	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 )
 
 func init() {
+	fanoutOptions["route"] = parseRoute
 	caddy.RegisterPlugin("fanout", caddy.Plugin{
 		ServerType: "dns",
 		Action:     setup,
@@ -49,20 +50,20 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return plugin.Error("fanout", err)
 	}
-	l := len(f.clients)
-	if len(f.clients) > maxIPCount {
+	l := f.clientCount()
+	if l > maxIPCount {
 		return plugin.Error("fanout", errors.Errorf("more than %d TOs configured: %d", maxIPCount, l))
 	}
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		f.Next = next
+		f.setNext(next)
 		return f
 	})
 
 	c.OnStartup(func() error {
 		if taph := dnsserver.GetConfig(c).Handler("dnstap"); taph != nil {
 			if tapPlugin, ok := taph.(*dnstap.Dnstap); ok {
-				f.tapPlugin = tapPlugin
+				f.setTapPlugin(tapPlugin)
 			}
 		}
 		return f.OnStartup()
@@ -74,14 +75,46 @@ func setup(c *caddy.Controller) error {
 
 // OnStartup starts a goroutines for all clients.
 func (f *Fanout) OnStartup() (err error) {
+	for _, c := range f.allClients() {
+		c.Start()
+	}
+	f.excludeDomains.startReload()
+	f.onlyDomains.startReload()
+	for _, r := range f.routes {
+		if err = r.OnStartup(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // OnShutdown stops all configured clients.
 func (f *Fanout) OnShutdown() error {
+	for _, c := range f.allClients() {
+		c.Stop()
+	}
+	f.excludeDomains.stopReload()
+	f.onlyDomains.stopReload()
+	for _, r := range f.routes {
+		logErrIfNotNil(r.OnShutdown())
+	}
 	return nil
 }
 
+func (f *Fanout) setNext(next plugin.Handler) {
+	f.Next = next
+	for _, r := range f.routes {
+		r.setNext(next)
+	}
+}
+
+func (f *Fanout) setTapPlugin(tapPlugin *dnstap.Dnstap) {
+	f.tapPlugin = tapPlugin
+	for _, r := range f.routes {
+		r.setTapPlugin(tapPlugin)
+	}
+}
+
 func parseFanout(c *caddy.Controller) (*Fanout, error) {
 	var (
 		f   *Fanout
@@ -114,11 +147,7 @@ func parsefanoutStanza(c *caddyfile.Dispenser) (*Fanout, error) {
 	}
 	f.from = normalized[0]
 
-	to := c.RemainingArgs()
-	if len(to) == 0 {
-		return f, c.ArgErr()
-	}
-	toHosts, err := parse.HostPortOrFile(to...)
+	toHosts, err := parseHosts(c.RemainingArgs())
 	if err != nil {
 		return f, err
 	}
@@ -128,94 +157,331 @@ func parsefanoutStanza(c *caddyfile.Dispenser) (*Fanout, error) {
 			return nil, err
 		}
 	}
+	toHosts, ok := primaryHosts(f, toHosts)
+	if !ok {
+		return f, c.ArgErr()
+	}
 	initClients(f, toHosts)
-	err = initServerSelectionPolicy(f)
+	err = initServerSelectionPolicy(f, toHosts)
 	if err != nil {
 		return nil, err
 	}
+	initTiers(f)
 
 	if f.workerCount > len(f.clients) || f.workerCount == 0 {
 		f.workerCount = len(f.clients)
 	}
+	if err = validateFanout(f); err != nil {
+		return nil, err
+	}
+	initCache(f)
 
 	return f, nil
 }
 
+// primaryHosts returns the upstreams of the fanout line with the upstreams declared by upstream option.
+// The first tier is the primary one if there are no such upstreams. False is returned if there are no upstreams at all.
+func primaryHosts(f *Fanout, toHosts []string) ([]string, bool) {
+	for _, u := range f.upstreams {
+		if !f.declared(u.host, toHosts) {
+			toHosts = append(toHosts, u.host)
+		}
+	}
+	if len(toHosts) > 0 {
+		return toHosts, true
+	}
+	if len(f.tiers) == 0 {
+		return nil, false
+	}
+	toHosts = f.tiers[0].hosts
+	f.tiers = f.tiers[1:]
+	return toHosts, true
+}
+
+// validateFanout checks the options which can't be used together
+func validateFanout(f *Fanout) error {
+	if f.merge && f.consensus > 0 {
+		return errors.New("merge and consensus can't be used together")
+	}
+	if f.consensus > f.serverCount {
+		return errors.Errorf("consensus %d is more than the number of requested upstreams %d", f.consensus, f.serverCount)
+	}
+	for _, t := range f.tiers {
+		if f.consensus > t.serverCount {
+			return errors.Errorf("consensus %d is more than the number of upstreams %d in tier %s", f.consensus, t.serverCount, t.name)
+		}
+	}
+	if f.cacheConfig.Capacity == 0 && f.cacheConfig.PrefetchAmount > 0 {
+		return errors.New("prefetch requires cache")
+	}
+	return nil
+}
+
+// initCache creates the response cache. serve-stale without cache only stores the responses
+func initCache(f *Fanout) {
+	if f.cacheConfig.Capacity == 0 && f.cacheConfig.StaleDuration == 0 {
+		return
+	}
+	cfg := f.cacheConfig
+	if cfg.Capacity == 0 {
+		cfg.Capacity = defaultCacheCapacity
+	}
+	f.cache = newResponseCache(cfg)
+}
+
+// parseHosts parses upstream addresses. The URL path of DNS-over-HTTPS upstreams and the TLS server name
+// of encrypted upstreams are kept as is.
+func parseHosts(to []string) ([]string, error) {
+	var hosts []string
+	for _, h := range to {
+		h, serverName := splitServerName(h)
+		if serverName != "" {
+			if trans, _ := parse.Transport(h); trans == transport.DNS {
+				return nil, errors.Errorf("server name %s is allowed only for encrypted upstreams", serverName)
+			}
+			serverName = "#" + serverName
+		}
+		h, path := splitURLPath(h)
+		parsed, err := parse.HostPortOrFile(h)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parsed {
+			hosts = append(hosts, p+path+serverName)
+		}
+	}
+	return hosts, nil
+}
+
+// splitServerName splits tls://addr#name or tls://addr@name upstream into the upstream and the TLS server name.
+// Unquoted # starts a comment in Corefile, so @ is accepted to set the server name without quotes.
+func splitServerName(host string) (addr, serverName string) {
+	if i := strings.LastIndexAny(host, "#@"); i != -1 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// splitURLPath splits https://addr/path upstream into the address and the path
+func splitURLPath(host string) (addr, path string) {
+	trans, h := parse.Transport(host)
+	if trans != transport.HTTPS {
+		return host, ""
+	}
+	if i := strings.Index(h, "/"); i != -1 {
+		return host[:len(host)-len(h)+i], h[i:]
+	}
+	return host, ""
+}
+
 func initClients(f *Fanout, hosts []string) {
+	f.clients = append(f.clients, newClients(f, hosts)...)
+}
+
+// initTiers creates clients of the tiers. All clients of a tier are requested in parallel
+// using the same selection policy as the primary upstreams.
+func initTiers(f *Fanout) {
+	for _, t := range f.tiers {
+		t.clients = newClients(f, t.hosts)
+		t.workerCount = len(t.clients)
+		t.serverCount = len(t.clients)
+		t.policy = newPolicy(f, t.clients, upstreamWeights(f, t.hosts, equalLoadFactor(len(t.clients))))
+	}
+}
+
+func newClients(f *Fanout, hosts []string) []Client {
+	clients := make([]Client, 0, len(hosts))
 	transports := make([]string, len(hosts))
+	serverNames := make([]string, len(hosts))
 	for i, host := range hosts {
+		host, serverNames[i] = splitServerName(host)
 		trans, h := parse.Transport(host)
-		f.clients = append(f.clients, NewClient(h, f.net))
+		var c Client
+		switch trans {
+		case transport.HTTPS:
+			path := defaultDoHPath
+			if idx := strings.Index(h, "/"); idx != -1 {
+				h, path = h[:idx], h[idx:]
+			}
+			c = NewDoHClient(h, path, f.dohMethod)
+		case transport.QUIC:
+			c = NewDoQClient(h)
+		default:
+			net := f.net
+			if u := f.upstream(hosts[i]); u != nil && u.net != "" {
+				net = u.net
+			}
+			c = NewClient(h, net)
+		}
+		if u := f.upstream(hosts[i]); u != nil && u.timeout > 0 {
+			f.clientTimeouts[c] = u.timeout
+		}
+		c.SetExpire(f.expire)
+		c.SetMaxIdleConns(f.maxIdleConns)
+		c.SetTruncationFallback(f.truncationFallback)
+		c.SetHealthCheck(f.healthCheck)
+		c.SetCircuitBreaker(f.circuitBreaker)
+		clients = append(clients, c)
 		transports[i] = trans
 	}
 
 	f.tlsConfig.ServerName = f.tlsServerName
-	for i := range f.clients {
-		if transports[i] == transport.TLS {
-			f.clients[i].SetTLSConfig(f.tlsConfig)
+	for i := range clients {
+		u := f.upstream(hosts[i])
+		switch {
+		case transports[i] == transport.TLS, transports[i] == transport.HTTPS, transports[i] == transport.QUIC, u.usesTLS():
+			clients[i].SetTLSConfig(f.tlsConfigOf(u, serverNames[i]))
 		}
 	}
+	return clients
 }
 
-func initServerSelectionPolicy(f *Fanout) error {
+func initServerSelectionPolicy(f *Fanout, hosts []string) error {
 	if f.serverCount > len(f.clients) || f.serverCount == 0 {
 		f.serverCount = len(f.clients)
 	}
 
 	loadFactor := f.loadFactor
 	if len(loadFactor) == 0 {
-		for i := 0; i < len(f.clients); i++ {
-			loadFactor = append(loadFactor, maxLoadFactor)
-		}
+		loadFactor = equalLoadFactor(len(f.clients))
 	}
 	if len(loadFactor) != len(f.clients) {
 		return errors.New("load-factor params count must be the same as the number of hosts")
 	}
+	f.serverSelectionPolicy = newPolicy(f, f.clients, upstreamWeights(f, hosts, loadFactor))
+
+	return nil
+}
 
-	f.serverSelectionPolicy = &sequentialPolicy{}
-	if f.policyType == policyWeightedRandom {
-		f.serverSelectionPolicy = &weightedPolicy{
+func newPolicy(f *Fanout, clients []Client, loadFactor []int) policy {
+	switch f.policyType {
+	case policyWeightedRandom:
+		return &weightedPolicy{
 			loadFactor: loadFactor,
-			//nolint:gosec // it's overhead to use crypto/rand here
-			r: rand.New(rand.NewSource(time.Now().UnixNano())),
+			r:          newLockedRand(),
 		}
+	case policyFastest:
+		return &fastestPolicy{
+			explore: f.explore,
+			r:       newLockedRand(),
+		}
+	case policyP2C:
+		return &p2cPolicy{
+			r: newLockedRand(),
+		}
+	case policyConsistentHash:
+		return newConsistentHashPolicy(clients, f.hashQType, f.hashLoadFactor)
+	default:
+		return &sequentialPolicy{}
 	}
+}
 
-	return nil
+// upstreamWeights returns the load factor with the weights of the upstreams applied
+func upstreamWeights(f *Fanout, hosts []string, loadFactor []int) []int {
+	weights := append([]int(nil), loadFactor...)
+	for i, host := range hosts {
+		if u := f.upstream(host); u != nil && u.weight > 0 {
+			weights[i] = u.weight
+		}
+	}
+	return weights
+}
+
+func equalLoadFactor(count int) []int {
+	loadFactor := make([]int, count)
+	for i := range loadFactor {
+		loadFactor[i] = maxLoadFactor
+	}
+	return loadFactor
+}
+
+// optionParser parses a single option of the fanout block
+type optionParser func(f *Fanout, c *caddyfile.Dispenser) error
+
+// fanoutOptions maps the options of the fanout block to their parsers. The route option is added in init
+// because its parser parses nested fanout blocks.
+var fanoutOptions = map[string]optionParser{
+	"tls":                           parseTLS,
+	"network":                       parseProtocol,
+	"tls-server":                    parseTLSServer,
+	"worker-count":                  parseWorkerCount,
+	"policy":                        parsePolicy,
+	"weighted-random-server-count":  intOption(func(f *Fanout) *int { return &f.serverCount }),
+	"weighted-random-load-factor":   parseLoadFactor,
+	"fastest-explore":               parseExplore,
+	"consistent-hash-key":           parseHashKey,
+	"consistent-hash-load-factor":   parseHashLoadFactor,
+	"timeout":                       parseTimeout,
+	"tier":                          parseTier,
+	"upstream":                      parseUpstream,
+	"tier-timeout":                  parseTierTimeout,
+	"cache":                         parseCache,
+	"cache-max-ttl":                 parseCacheMaxTTL,
+	"prefetch":                      parsePrefetch,
+	"serve-stale":                   parseServeStale,
+	"race":                          parseRace,
+	"prefer":                        parsePrefer,
+	"prefer-finish":                 parsePreferFinish,
+	"merge":                         parseMerge,
+	"consensus":                     intOption(func(f *Fanout) *int { return &f.consensus }),
+	"hedge":                         parseHedge,
+	"truncation-fallback":           parseTruncationFallback,
+	"except":                        domainListOption(parseDomainNames, func(f *Fanout) *domainList { return f.excludeDomains }),
+	"except-file":                   domainListOption(parseDomainListFile, func(f *Fanout) *domainList { return f.excludeDomains }),
+	"except-file-reload":            domainListOption(parseReload, func(f *Fanout) *domainList { return f.excludeDomains }),
+	"except-qtype":                  func(f *Fanout, c *caddyfile.Dispenser) error { return parseQTypes(f.exceptQTypes, c) },
+	"only-qtype":                    func(f *Fanout, c *caddyfile.Dispenser) error { return parseQTypes(f.onlyQTypes, c) },
+	"qtype-action":                  parseQTypeAction,
+	"only":                          domainListOption(parseDomainNames, func(f *Fanout) *domainList { return f.onlyDomains }),
+	"only-file":                     domainListOption(parseDomainListFile, func(f *Fanout) *domainList { return f.onlyDomains }),
+	"only-file-reload":              domainListOption(parseReload, func(f *Fanout) *domainList { return f.onlyDomains }),
+	"attempt-count":                 intOption(func(f *Fanout) *int { return &f.attempts }),
+	"expire":                        parseExpire,
+	"health-check":                  parseHealthCheck,
+	"health-check-query":            parseHealthCheckQuery,
+	"health-check-fails":            countOption("health-check-fails", func(f *Fanout) *int { return &f.healthCheck.Fails }),
+	"health-check-successes":        countOption("health-check-successes", func(f *Fanout) *int { return &f.healthCheck.Successes }),
+	"health-check-all-down":         parseAllDown,
+	"circuit-breaker-failures":      intOption(func(f *Fanout) *int { return &f.circuitBreaker.Failures }),
+	"circuit-breaker-servfail-rate": parseServFailRate,
+	"circuit-breaker-ejection":      parseEjection,
+	"doh-method":                    parseDoHMethod,
+	"max-idle-conns":                intOption(func(f *Fanout) *int { return &f.maxIdleConns }),
 }
 
 func parseValue(v string, f *Fanout, c *caddyfile.Dispenser) error {
-	switch v {
-	case "tls":
-		return parseTLS(f, c)
-	case "network":
-		return parseProtocol(f, c)
-	case "tls-server":
-		return parseTLSServer(f, c)
-	case "worker-count":
-		return parseWorkerCount(f, c)
-	case "policy":
-		return parsePolicy(f, c)
-	case "weighted-random-server-count":
-		serverCount, err := parsePositiveInt(c)
-		f.serverCount = serverCount
+	parseOption, ok := fanoutOptions[v]
+	if !ok {
+		return errors.Errorf("unknown property %v", v)
+	}
+	return parseOption(f, c)
+}
+
+// intOption returns the parser of a non-negative number option
+func intOption(dst func(f *Fanout) *int) optionParser {
+	return func(f *Fanout, c *caddyfile.Dispenser) error {
+		num, err := parsePositiveInt(c)
+		*dst(f) = num
 		return err
-	case "weighted-random-load-factor":
-		return parseLoadFactor(f, c)
-	case "timeout":
-		return parseTimeout(f, c)
-	case "race":
-		return parseRace(f, c)
-	case "except":
-		return parseIgnored(f, c)
-	case "except-file":
-		return parseIgnoredFromFile(f, c)
-	case "attempt-count":
+	}
+}
+
+// countOption returns the parser of a positive number option
+func countOption(name string, dst func(f *Fanout) *int) optionParser {
+	return func(f *Fanout, c *caddyfile.Dispenser) error {
 		num, err := parsePositiveInt(c)
-		f.attempts = num
+		if err == nil && num == 0 {
+			return errors.Errorf("%s should be more or equal 1", name)
+		}
+		*dst(f) = num
 		return err
-	default:
-		return errors.Errorf("unknown property %v", v)
+	}
+}
+
+// domainListOption returns the parser of an option of the except or only domain list
+func domainListOption(parseList func(l *domainList, c *caddyfile.Dispenser) error, list func(f *Fanout) *domainList) optionParser {
+	return func(f *Fanout, c *caddyfile.Dispenser) error {
+		return parseList(list(f), c)
 	}
 }
 
@@ -225,7 +491,9 @@ func parsePolicy(f *Fanout, c *caddyfile.Dispenser) error {
 	}
 
 	policyType := strings.ToLower(c.Val())
-	if policyType != policyWeightedRandom && policyType != policySequential {
+	switch policyType {
+	case policyWeightedRandom, policySequential, policyFastest, policyP2C, policyConsistentHash:
+	default:
 		return errors.Errorf("unknown policy %q", c.Val())
 	}
 	f.policyType = policyType
@@ -233,56 +501,586 @@ func parsePolicy(f *Fanout, c *caddyfile.Dispenser) error {
 	return nil
 }
 
+func parseExplore(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	explore, err := strconv.ParseFloat(c.Val(), 64)
+	if err != nil {
+		return c.ArgErr()
+	}
+	if explore < 0 || explore > 1 {
+		return errors.Errorf("explore probability %v should be in range [0, 1]", explore)
+	}
+	f.explore = explore
+	return nil
+}
+
+func parseHashKey(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	switch strings.ToLower(c.Val()) {
+	case hashKeyQName:
+		f.hashQType = false
+	case hashKeyQNameQType:
+		f.hashQType = true
+	default:
+		return errors.Errorf("unknown consistent hash key %q", c.Val())
+	}
+	return nil
+}
+
+func parseHashLoadFactor(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	loadFactor, err := strconv.ParseFloat(c.Val(), 64)
+	if err != nil {
+		return c.ArgErr()
+	}
+	if loadFactor != 0 && loadFactor < 1 {
+		return errors.Errorf("consistent hash load factor %v should be 0 or more or equal 1", loadFactor)
+	}
+	f.hashLoadFactor = loadFactor
+	return nil
+}
+
 func parseTimeout(f *Fanout, c *caddyfile.Dispenser) error {
+	return parseDuration(&f.timeout, c)
+}
+
+// parseRoute parses a route with its own upstreams and options as a separate fanout stanza:
+// route ZONE TO... { OPTIONS }
+func parseRoute(f *Fanout, c *caddyfile.Dispenser) error {
+	line := c.Line()
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return c.ArgErr()
+	}
+	normalized := plugin.Host(args[0]).NormalizeExact()
+	if len(normalized) == 0 {
+		return errors.Errorf("unable to normalize '%s'", args[0])
+	}
+	zone := normalized[0]
+	if zone == f.from || !plugin.Name(f.from).Matches(zone) {
+		return errors.Errorf("route zone %s should be a subdomain of %s", zone, f.from)
+	}
+	if _, ok := f.routes[zone]; ok {
+		return errors.Errorf("route %s is already defined", zone)
+	}
+
+	tokens := []caddyfile.Token{{File: c.File(), Line: line, Text: "fanout"}}
+	for _, arg := range append([]string{zone}, args[1:]...) {
+		tokens = append(tokens, caddyfile.Token{File: c.File(), Line: line, Text: arg})
+	}
+	if c.NextArg() {
+		tokens = append(tokens, caddyfile.Token{File: c.File(), Line: line, Text: c.Val()})
+		for nesting := 1; nesting > 0; {
+			if !c.Next() {
+				return c.EOFErr()
+			}
+			switch c.Val() {
+			case "{":
+				nesting++
+			case "}":
+				nesting--
+			}
+			tokens = append(tokens, caddyfile.Token{File: c.File(), Line: c.Line(), Text: c.Val()})
+		}
+	}
+
+	d := caddyfile.NewDispenserTokens(c.File(), tokens)
+	d.Next()
+	r, err := parsefanoutStanza(&d)
+	if err != nil {
+		return errors.Wrapf(err, "route %s", zone)
+	}
+	f.routes[zone] = r
+	f.routeDomains.AddString(zone)
+	return nil
+}
+
+func parseUpstream(f *Fanout, c *caddyfile.Dispenser) error {
 	if !c.NextArg() {
 		return c.ArgErr()
 	}
-	var err error
-	val := c.Val()
-	f.timeout, err = time.ParseDuration(val)
-	return err
+	hosts, err := parseHosts([]string{c.Val()})
+	if err != nil {
+		return err
+	}
+	if len(hosts) != 1 {
+		return errors.Errorf("upstream %s should be a single address", c.Val())
+	}
+	if f.upstream(hosts[0]) != nil {
+		return errors.Errorf("upstream %s is already defined", hosts[0])
+	}
+	u := &upstream{host: hosts[0]}
+	f.upstreams = append(f.upstreams, u)
+	if !c.NextArg() {
+		return nil
+	}
+	if c.Val() != "{" {
+		return c.ArgErr()
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		if err = parseUpstreamValue(strings.ToLower(c.Val()), u, c); err != nil {
+			return errors.Wrapf(err, "upstream %s", u.host)
+		}
+	}
+	return c.EOFErr()
 }
 
-func parseRace(f *Fanout, c *caddyfile.Dispenser) error {
+// upstreamOptions maps the options of the upstream block to their parsers
+var upstreamOptions = map[string]func(u *upstream, c *caddyfile.Dispenser) error{
+	"weight":     parseUpstreamWeight,
+	"timeout":    parseUpstreamTimeout,
+	"network":    func(u *upstream, c *caddyfile.Dispenser) error { return parseNetwork(&u.net, c) },
+	"tls":        func(u *upstream, c *caddyfile.Dispenser) error { return parseTLSConfig(&u.tlsConfig, c) },
+	"tls-server": func(u *upstream, c *caddyfile.Dispenser) error { return parseServerName(&u.tlsServerName, c) },
+}
+
+func parseUpstreamValue(v string, u *upstream, c *caddyfile.Dispenser) error {
+	parseOption, ok := upstreamOptions[v]
+	if !ok {
+		return errors.Errorf("unknown upstream property %v", v)
+	}
+	if err := parseOption(u, c); err != nil {
+		return err
+	}
 	if c.NextArg() {
 		return c.ArgErr()
 	}
-	f.race = true
 	return nil
 }
 
-func parseIgnoredFromFile(f *Fanout, c *caddyfile.Dispenser) error {
+func parseUpstreamWeight(u *upstream, c *caddyfile.Dispenser) error {
+	weight, err := parsePositiveInt(c)
+	if err != nil {
+		return err
+	}
+	if weight < minLoadFactor || weight > maxLoadFactor {
+		return errors.Errorf("weight %d should be in range [%d, %d]", weight, minLoadFactor, maxLoadFactor)
+	}
+	u.weight = weight
+	return nil
+}
+
+func parseUpstreamTimeout(u *upstream, c *caddyfile.Dispenser) error {
+	if err := parseDuration(&u.timeout, c); err != nil {
+		return err
+	}
+	if u.timeout <= 0 {
+		return errors.Errorf("timeout should be positive: %s", u.timeout)
+	}
+	return nil
+}
+
+func parseTier(f *Fanout, c *caddyfile.Dispenser) error {
 	args := c.RemainingArgs()
-	if len(args) != 1 {
+	if len(args) < 2 {
+		return c.ArgErr()
+	}
+	name := args[0]
+	for _, t := range f.tiers {
+		if t.name == name {
+			return errors.Errorf("tier %q is already defined", name)
+		}
+	}
+	hosts, err := parseHosts(args[1:])
+	if err != nil {
+		return err
+	}
+	f.tiers = append(f.tiers, &tier{name: name, hosts: hosts})
+	return nil
+}
+
+func parseTierTimeout(f *Fanout, c *caddyfile.Dispenser) error {
+	if err := parseDuration(&f.tierTimeout, c); err != nil {
+		return err
+	}
+	if f.tierTimeout < 0 {
+		return errors.Errorf("tier-timeout can't be negative: %s", f.tierTimeout)
+	}
+	return nil
+}
+
+func parseCache(f *Fanout, c *caddyfile.Dispenser) error {
+	f.cacheConfig.Capacity = defaultCacheCapacity
+	if !c.NextArg() {
+		return nil
+	}
+	capacity, err := strconv.Atoi(c.Val())
+	if err != nil || capacity < 1 {
+		return errors.Errorf("cache capacity should be a positive number: %s", c.Val())
+	}
+	f.cacheConfig.Capacity = capacity
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	return nil
+}
+
+func parseCacheMaxTTL(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	ttls := make([]time.Duration, len(args))
+	for i, arg := range args {
+		ttl, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		if ttl < time.Second {
+			return errors.Errorf("cache max TTL should be at least 1s: %s", ttl)
+		}
+		ttls[i] = ttl
+	}
+	f.cacheConfig.MaxTTL = ttls[0]
+	if len(ttls) == 2 {
+		f.cacheConfig.MaxNegativeTTL = ttls[1]
+	}
+	return nil
+}
+
+func parsePrefetch(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 3 {
+		return c.ArgErr()
+	}
+	amount, err := strconv.Atoi(args[0])
+	if err != nil || amount < 1 {
+		return errors.Errorf("prefetch amount should be a positive number: %s", args[0])
+	}
+	f.cacheConfig.PrefetchAmount = amount
+	for _, arg := range args[1:] {
+		if strings.HasSuffix(arg, "%") {
+			percentage, convErr := strconv.Atoi(strings.TrimSuffix(arg, "%"))
+			if convErr != nil || percentage < 1 || percentage > 100 {
+				return errors.Errorf("prefetch percentage should be in range [1%%, 100%%]: %s", arg)
+			}
+			f.cacheConfig.PrefetchPercentage = percentage
+			continue
+		}
+		duration, parseErr := time.ParseDuration(arg)
+		if parseErr != nil {
+			return parseErr
+		}
+		if duration <= 0 {
+			return errors.Errorf("prefetch duration should be positive: %s", duration)
+		}
+		f.cacheConfig.PrefetchDuration = duration
+	}
+	return nil
+}
+
+func parseServeStale(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) > 2 {
+		return c.ArgErr()
+	}
+	f.cacheConfig.StaleDuration = defaultStaleDuration
+	f.cacheConfig.StaleTTL = defaultStaleTTL
+	if len(args) > 0 {
+		duration, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		if duration <= 0 {
+			return errors.Errorf("serve-stale duration should be positive: %s", duration)
+		}
+		f.cacheConfig.StaleDuration = duration
+	}
+	if len(args) > 1 {
+		ttl, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		if ttl < time.Second {
+			return errors.Errorf("serve-stale TTL should be at least 1s: %s", ttl)
+		}
+		f.cacheConfig.StaleTTL = ttl
+	}
+	return nil
+}
+
+func parseExpire(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	expire, err := time.ParseDuration(c.Val())
+	if err != nil {
+		return err
+	}
+	if expire < 0 {
+		return errors.Errorf("expire can't be negative: %s", expire)
+	}
+	f.expire = expire
+	return nil
+}
+
+func parseHealthCheck(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
 		return c.ArgErr()
 	}
-	b, err := os.ReadFile(filepath.Clean(args[0]))
+	interval, err := time.ParseDuration(c.Val())
 	if err != nil {
 		return err
 	}
-	names := strings.Split(string(b), "\n")
-	for i := 0; i < len(names); i++ {
-		normalized := plugin.Host(names[i]).NormalizeExact()
-		if len(normalized) == 0 {
-			return errors.Errorf("unable to normalize '%s'", names[i])
+	if interval < 0 {
+		return errors.Errorf("health-check interval can't be negative: %s", interval)
+	}
+	f.healthCheck.Interval = interval
+	return nil
+}
+
+func parseHealthCheckQuery(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	normalized := plugin.Host(c.Val()).NormalizeExact()
+	if len(normalized) == 0 {
+		return errors.Errorf("unable to normalize '%s'", c.Val())
+	}
+	f.healthCheck.Query = normalized[0]
+	return nil
+}
+
+func parseAllDown(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	switch strings.ToLower(c.Val()) {
+	case allDownAny:
+		f.allDownServFail = false
+	case allDownServFail:
+		f.allDownServFail = true
+	default:
+		return errors.Errorf("unknown all-down mode %q", c.Val())
+	}
+	return nil
+}
+
+func parseServFailRate(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return c.ArgErr()
+	}
+	if rate <= 0 || rate > 1 {
+		return errors.Errorf("servfail rate %v should be in range (0, 1]", rate)
+	}
+	f.circuitBreaker.ServFailRate = rate
+	if len(args) == 2 {
+		window, convErr := strconv.Atoi(args[1])
+		if convErr != nil || window < 1 {
+			return errors.Errorf("servfail window should be a positive number: %s", args[1])
 		}
-		f.excludeDomains.AddString(normalized[0])
+		f.circuitBreaker.Window = window
 	}
 	return nil
 }
 
-func parseIgnored(f *Fanout, c *caddyfile.Dispenser) error {
-	ignore := c.RemainingArgs()
-	if len(ignore) == 0 {
+func parseEjection(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
 		return c.ArgErr()
 	}
-	for i := 0; i < len(ignore); i++ {
-		normalized := plugin.Host(ignore[i]).NormalizeExact()
-		if len(normalized) == 0 {
-			return errors.Errorf("unable to normalize '%s'", ignore[i])
+	periods := make([]time.Duration, len(args))
+	for i, arg := range args {
+		period, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
 		}
-		f.excludeDomains.AddString(normalized[0])
+		if period <= 0 {
+			return errors.Errorf("ejection period should be positive: %s", period)
+		}
+		periods[i] = period
+	}
+	f.circuitBreaker.BaseEjection = periods[0]
+	if len(periods) == 2 {
+		f.circuitBreaker.MaxEjection = periods[1]
+	}
+	if f.circuitBreaker.MaxEjection < f.circuitBreaker.BaseEjection {
+		return errors.Errorf("max ejection period %s is less than base %s", f.circuitBreaker.MaxEjection, f.circuitBreaker.BaseEjection)
+	}
+	return nil
+}
+
+func parseDoHMethod(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	method := strings.ToUpper(c.Val())
+	if method != http.MethodGet && method != http.MethodPost {
+		return errors.Errorf("unknown DoH method %q", c.Val())
+	}
+	f.dohMethod = method
+	return nil
+}
+
+func parseHedge(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	f.hedge = true
+	if strings.ToLower(c.Val()) == hedgeAuto {
+		f.hedgeDelay = 0
+		return nil
+	}
+	delay, err := time.ParseDuration(c.Val())
+	if err != nil {
+		return err
+	}
+	if delay <= 0 {
+		return errors.Errorf("hedge delay should be positive: %s", delay)
 	}
+	f.hedgeDelay = delay
+	return nil
+}
+
+func parsePrefer(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	ranks := make(map[string]int)
+	var tiebreaks []string
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		arg = strings.ToLower(arg)
+		if seen[arg] {
+			return errors.Errorf("duplicate prefer value %q", arg)
+		}
+		seen[arg] = true
+		switch arg {
+		case classAnswer, classNoData, classNXDomain, classServFail, classOther:
+			if len(tiebreaks) > 0 {
+				return errors.Errorf("response class %q should be specified before properties", arg)
+			}
+			ranks[arg] = len(ranks)
+		case tiebreakAD, tiebreakNoTC:
+			tiebreaks = append(tiebreaks, arg)
+		default:
+			return errors.Errorf("unknown prefer value %q", arg)
+		}
+	}
+	if len(ranks) > 0 {
+		f.preference.ranks = ranks
+		f.preference.defaultRank = len(ranks)
+	}
+	f.preference.tiebreaks = tiebreaks
+	return nil
+}
+
+func parsePreferFinish(f *Fanout, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	finish := make(map[string]bool)
+	for _, arg := range args {
+		arg = strings.ToLower(arg)
+		switch arg {
+		case classAnswer, classNoData, classNXDomain, classServFail, classOther:
+			finish[arg] = true
+		default:
+			return errors.Errorf("unknown response class %q", arg)
+		}
+	}
+	f.preference.finish = finish
+	return nil
+}
+
+func parseMerge(f *Fanout, c *caddyfile.Dispenser) error {
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	f.merge = true
+	return nil
+}
+
+func parseRace(f *Fanout, c *caddyfile.Dispenser) error {
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	f.race = true
+	return nil
+}
+
+func parseTruncationFallback(f *Fanout, c *caddyfile.Dispenser) error {
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+	f.truncationFallback = true
+	return nil
+}
+
+func parseDomainListFile(l *domainList, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	return l.addFile(args[0])
+}
+
+func parseDomainNames(l *domainList, c *caddyfile.Dispenser) error {
+	names := c.RemainingArgs()
+	if len(names) == 0 {
+		return c.ArgErr()
+	}
+	return l.addNames(names)
+}
+
+func parseQTypes(qtypes map[uint16]bool, c *caddyfile.Dispenser) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	for _, arg := range args {
+		qtype, ok := dns.StringToType[strings.ToUpper(arg)]
+		if !ok {
+			return errors.Errorf("unknown query type %q", arg)
+		}
+		qtypes[qtype] = true
+	}
+	return nil
+}
+
+func parseQTypeAction(f *Fanout, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	switch strings.ToLower(c.Val()) {
+	case qtypeActionNext:
+		f.qtypeNoData = false
+	case qtypeActionNoData:
+		f.qtypeNoData = true
+	default:
+		return errors.Errorf("unknown qtype action %q", c.Val())
+	}
+	return nil
+}
+
+func parseReload(l *domainList, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	interval, err := time.ParseDuration(c.Val())
+	if err != nil {
+		return err
+	}
+	if interval < 0 {
+		return errors.Errorf("%s-file-reload can't be negative: %s", l.option, interval)
+	}
+	l.interval = interval
 	return nil
 }
 
@@ -341,14 +1139,26 @@ func parsePositiveInt(c *caddyfile.Dispenser) (int, error) {
 }
 
 func parseTLSServer(f *Fanout, c *caddyfile.Dispenser) error {
+	return parseServerName(&f.tlsServerName, c)
+}
+
+func parseProtocol(f *Fanout, c *caddyfile.Dispenser) error {
+	return parseNetwork(&f.net, c)
+}
+
+func parseTLS(f *Fanout, c *caddyfile.Dispenser) error {
+	return parseTLSConfig(&f.tlsConfig, c)
+}
+
+func parseServerName(dst *string, c *caddyfile.Dispenser) error {
 	if !c.NextArg() {
 		return c.ArgErr()
 	}
-	f.tlsServerName = c.Val()
+	*dst = c.Val()
 	return nil
 }
 
-func parseProtocol(f *Fanout, c *caddyfile.Dispenser) error {
+func parseNetwork(dst *string, c *caddyfile.Dispenser) error {
 	if !c.NextArg() {
 		return c.ArgErr()
 	}
@@ -356,11 +1166,11 @@ func parseProtocol(f *Fanout, c *caddyfile.Dispenser) error {
 	if net != tcp && net != udp && net != tcptls {
 		return errors.New("unknown network protocol")
 	}
-	f.net = net
+	*dst = net
 	return nil
 }
 
-func parseTLS(f *Fanout, c *caddyfile.Dispenser) error {
+func parseTLSConfig(dst **cryptotls.Config, c *caddyfile.Dispenser) error {
 	args := c.RemainingArgs()
 	if len(args) > 3 {
 		return c.ArgErr()
@@ -370,6 +1180,18 @@ func parseTLS(f *Fanout, c *caddyfile.Dispenser) error {
 	if err != nil {
 		return err
 	}
-	f.tlsConfig = tlsConfig
+	*dst = tlsConfig
+	return nil
+}
+
+func parseDuration(dst *time.Duration, c *caddyfile.Dispenser) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	d, err := time.ParseDuration(c.Val())
+	if err != nil {
+		return err
+	}
+	*dst = d
 	return nil
 }
@@ -19,6 +19,8 @@
 package fanout
 
 import (
+	"crypto/tls"
+	"fmt"
 	"os"
 	"reflect"
 	"strings"
@@ -47,12 +49,20 @@ func TestSetup(t *testing.T) {
 		{input: "fanout . 127.0.0.1 {\npolicy weighted-random \nweighted-random-server-count 5 weighted-random-load-factor 100\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 1, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 1, expectedLoadFactor: []int{100}, expectedPolicy: policyWeightedRandom},
 		{input: "fanout . 127.0.0.1", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 1, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 1, expectedLoadFactor: nil, expectedPolicy: ""},
 		{input: "fanout . 127.0.0.1 {\npolicy weighted-random \nserver-count 5 load-factor 100\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 1, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 1, expectedLoadFactor: []int{100}, expectedPolicy: policyWeightedRandom},
+		{input: "fanout . 127.0.0.1 {\nexcept *.a api.*.b regex:^c[0-9]+\\.$\n}", expectedFrom: ".", expectedTimeout: defaultTimeout, expectedAttempts: 3, expectedWorkers: 1, expectedIgnored: []string{"x.a.", "api.x.b.", "c10."}, expectedNetwork: "udp", expectedServerCount: 1, expectedLoadFactor: nil, expectedPolicy: ""},
 		{input: "fanout . 127.0.0.1 {\nexcept a b\nworker-count 3\n}", expectedFrom: ".", expectedTimeout: defaultTimeout, expectedAttempts: 3, expectedWorkers: 1, expectedIgnored: []string{"a.", "b."}, expectedNetwork: "udp", expectedServerCount: 1, expectedLoadFactor: nil, expectedPolicy: ""},
 		{input: "fanout . 127.0.0.1 127.0.0.2 {\nnetwork tcp\n}", expectedFrom: ".", expectedTimeout: defaultTimeout, expectedAttempts: 3, expectedWorkers: 2, expectedNetwork: "tcp", expectedTo: []string{"127.0.0.1:53", "127.0.0.2:53"}, expectedServerCount: 2, expectedLoadFactor: nil, expectedPolicy: ""},
 		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 127.0.0.4 {\nworker-count 3\ntimeout 1m\n}", expectedTimeout: time.Minute, expectedAttempts: 3, expectedFrom: ".", expectedWorkers: 3, expectedNetwork: "udp", expectedServerCount: 4, expectedLoadFactor: nil, expectedPolicy: ""},
 		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 127.0.0.4 {\nattempt-count 2\n}", expectedTimeout: defaultTimeout, expectedFrom: ".", expectedAttempts: 2, expectedWorkers: 4, expectedNetwork: "udp", expectedServerCount: 4, expectedLoadFactor: nil, expectedPolicy: ""},
 		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 {\npolicy weighted-random \n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 3, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 3, expectedLoadFactor: []int{100, 100, 100}, expectedPolicy: policyWeightedRandom},
 		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 {\npolicy sequential\nworker-count 3\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 3, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 3, expectedLoadFactor: nil, expectedPolicy: policySequential},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\npolicy fastest\nfastest-explore 0.2\nworker-count 2\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 2, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 2, expectedLoadFactor: nil, expectedPolicy: policyFastest},
+		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 {\nconsensus 2\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 3, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 3, expectedLoadFactor: nil, expectedPolicy: ""},
+		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 {\npolicy p2c\nworker-count 2\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 2, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 3, expectedLoadFactor: nil, expectedPolicy: policyP2C},
+		{input: "fanout . 127.0.0.1 127.0.0.2 127.0.0.3 {\npolicy consistent-hash\nconsistent-hash-key qname-qtype\nconsistent-hash-load-factor 0\nworker-count 2\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 2, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 3, expectedLoadFactor: nil, expectedPolicy: policyConsistentHash},
+		{input: "fanout . https://127.0.0.1 https://127.0.0.2:8443/resolve {\ndoh-method get\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 2, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedTo: []string{"127.0.0.1:443", "127.0.0.2:8443"}, expectedServerCount: 2, expectedLoadFactor: nil, expectedPolicy: ""},
+		{input: "fanout . quic://127.0.0.1 tls://127.0.0.2", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 2, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedTo: []string{"127.0.0.1:853", "127.0.0.2:853"}, expectedServerCount: 2, expectedLoadFactor: nil, expectedPolicy: ""},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\nexpire 1m\nmax-idle-conns 0\n}", expectedFrom: ".", expectedAttempts: 3, expectedWorkers: 2, expectedTimeout: defaultTimeout, expectedNetwork: "udp", expectedServerCount: 2, expectedLoadFactor: nil, expectedPolicy: ""},
 
 		// negative
 		{input: "fanout . aaa", expectedErr: "not an IP address or file"},
@@ -67,6 +77,72 @@ func TestSetup(t *testing.T) {
 		{input: "fanout . 127.0.0.1 {\npolicy weighted-random \nweighted-random-load-factor 50 100\n}", expectedErr: "load-factor params count must be the same as the number of hosts"},
 		{input: "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random \nweighted-random-load-factor 50\n}", expectedErr: "load-factor params count must be the same as the number of hosts"},
 		{input: "fanout . 127.0.0.1 127.0.0.2 {\npolicy weighted-random \nweighted-random-load-factor \n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . https://127.0.0.1 {\ndoh-method put\n}", expectedErr: "unknown DoH method"},
+		{input: "fanout . https://example.com/dns-query", expectedErr: "not an IP address or file"},
+		{input: "fanout . 127.0.0.1 {\ntruncation-fallback yes\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nhealth-check -1s\n}", expectedErr: "health-check interval can't be negative"},
+		{input: "fanout . 127.0.0.1 {\nhealth-check-fails 0\n}", expectedErr: "health-check-fails should be more or equal 1"},
+		{input: "fanout . 127.0.0.1 {\nhealth-check-all-down random\n}", expectedErr: "unknown all-down mode"},
+		{input: "fanout . 127.0.0.1 {\nhealth-check-query a:\n}", expectedErr: "unable to normalize 'a:'"},
+		{input: "fanout . 127.0.0.1 {\ncircuit-breaker-servfail-rate 1.5\n}", expectedErr: "should be in range (0, 1]"},
+		{input: "fanout . 127.0.0.1 {\ncircuit-breaker-servfail-rate 0.5 0\n}", expectedErr: "servfail window should be a positive number"},
+		{input: "fanout . 127.0.0.1 {\ncircuit-breaker-ejection 10m\n}", expectedErr: "max ejection period 5m0s is less than base 10m0s"},
+		{input: "fanout . 127.0.0.1 {\ncircuit-breaker-ejection 0s\n}", expectedErr: "ejection period should be positive"},
+		{input: "fanout . 127.0.0.1 {\npolicy fastest\nfastest-explore 2\n}", expectedErr: "explore probability 2 should be in range [0, 1]"},
+		{input: "fanout . 127.0.0.1 {\npolicy slowest\n}", expectedErr: "unknown policy"},
+		{input: "fanout . 127.0.0.1 {\npolicy consistent-hash\nconsistent-hash-key qclass\n}", expectedErr: "unknown consistent hash key"},
+		{input: "fanout . 127.0.0.1 {\npolicy consistent-hash\nconsistent-hash-load-factor 0.5\n}", expectedErr: "should be 0 or more or equal 1"},
+		{input: "fanout . {\nrace\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\ntier backup\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\ntier backup 127.0.0.2\ntier backup 127.0.0.3\n}", expectedErr: "tier \"backup\" is already defined"},
+		{input: "fanout . 127.0.0.1 {\ntier backup 127.0.0.2\ntier-timeout -1s\n}", expectedErr: "tier-timeout can't be negative"},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\nconsensus 3\n}", expectedErr: "consensus 3 is more than the number of requested upstreams 2"},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\nconsensus 2\ntier backup 127.0.0.3\n}", expectedErr: "consensus 2 is more than the number of upstreams 1 in tier backup"},
+		{input: "fanout . 127.0.0.1 {\nprefer\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nprefer answer noerror\n}", expectedErr: "unknown prefer value \"noerror\""},
+		{input: "fanout . 127.0.0.1 {\nprefer answer answer\n}", expectedErr: "duplicate prefer value \"answer\""},
+		{input: "fanout . 127.0.0.1 {\nprefer ad answer\n}", expectedErr: "should be specified before properties"},
+		{input: "fanout . 127.0.0.1 {\nprefer-finish ad\n}", expectedErr: "unknown response class \"ad\""},
+		{input: "fanout . 127.0.0.1 {\nmerge all\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\nmerge\nconsensus 2\n}", expectedErr: "merge and consensus can't be used together"},
+		{input: "fanout example.org 127.0.0.1 {\nroute example.com 127.0.0.2\n}", expectedErr: "route zone example.com. should be a subdomain of example.org."},
+		{input: "fanout . 127.0.0.1 {\nroute example.com\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nroute example.com 127.0.0.2\nroute example.com 127.0.0.3\n}", expectedErr: "route example.com. is already defined"},
+		{input: "fanout . 127.0.0.1 {\nroute example.com 127.0.0.2 {\npolicy slowest\n}\n}", expectedErr: "route example.com.: unknown policy"},
+		{input: "fanout . 127.0.0.1 {\nroute example.com 127.0.0.2 {\npolicy fastest\n", expectedErr: "Unexpected EOF"},
+		{input: "fanout . 127.0.0.1 {\nexcept regex:[a-\n}", expectedErr: "invalid regular expression"},
+		{input: "fanout . 127.0.0.1 {\nexcept-qtype AAAAA\n}", expectedErr: "unknown query type \"AAAAA\""},
+		{input: "fanout . 127.0.0.1 {\nonly-qtype\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nqtype-action drop\n}", expectedErr: "unknown qtype action \"drop\""},
+		{input: "fanout . 127.0.0.1 {\nonly\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nonly a:\n}", expectedErr: "unable to normalize 'a:'"},
+		{input: "fanout . 127.0.0.1 {\nonly-file-reload -1s\n}", expectedErr: "only-file-reload can't be negative"},
+		{input: "fanout . 127.0.0.1 {\nexcept-file-reload -1s\n}", expectedErr: "except-file-reload can't be negative"},
+		{input: "fanout . 127.0.0.1 {\nexcept-file /not/existing/file\n}", expectedErr: "no such file or directory"},
+		{input: "fanout . 127.0.0.1 {\nhedge\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nhedge 0s\n}", expectedErr: "hedge delay should be positive"},
+		{input: "fanout . 127.0.0.1 {\nhedge sometimes\n}", expectedErr: "invalid duration"},
+		{input: "fanout . \"127.0.0.1#dns.example.com\"", expectedErr: "server name dns.example.com is allowed only for encrypted upstreams"},
+		{input: "fanout . 127.0.0.1 {\nupstream\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nupstream 127.0.0.2\nupstream 127.0.0.2:53\n}", expectedErr: "upstream 127.0.0.2:53 is already defined"},
+		{input: "fanout . 127.0.0.1 {\nupstream 127.0.0.2 {\nport 54\n}\n}", expectedErr: "upstream 127.0.0.2:53: unknown upstream property port"},
+		{input: "fanout . 127.0.0.1 {\nupstream 127.0.0.2 {\nweight 101\n}\n}", expectedErr: "weight 101 should be in range [1, 100]"},
+		{input: "fanout . 127.0.0.1 {\nupstream 127.0.0.2 {\ntimeout 0s\n}\n}", expectedErr: "timeout should be positive"},
+		{input: "fanout . 127.0.0.1 {\nupstream 127.0.0.2 {\nnetwork quic\n}\n}", expectedErr: "unknown network protocol"},
+		{input: "fanout . 127.0.0.1 {\nupstream 127.0.0.2 {\nnetwork tcp udp\n}\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nupstream 127.0.0.2 {\nnetwork tcp\n", expectedErr: "Unexpected EOF"},
+		{input: "fanout . 127.0.0.1 {\ncache 0\n}", expectedErr: "cache capacity should be a positive number"},
+		{input: "fanout . 127.0.0.1 {\ncache 10 20\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\ncache\ncache-max-ttl 0s\n}", expectedErr: "cache max TTL should be at least 1s"},
+		{input: "fanout . 127.0.0.1 {\ncache\nprefetch 0\n}", expectedErr: "prefetch amount should be a positive number"},
+		{input: "fanout . 127.0.0.1 {\ncache\nprefetch 2 1m 101%\n}", expectedErr: "prefetch percentage should be in range"},
+		{input: "fanout . 127.0.0.1 {\nprefetch 2\n}", expectedErr: "prefetch requires cache"},
+		{input: "fanout . 127.0.0.1 {\nserve-stale 0s\n}", expectedErr: "serve-stale duration should be positive"},
+		{input: "fanout . 127.0.0.1 {\nserve-stale 1h 0s\n}", expectedErr: "serve-stale TTL should be at least 1s"},
+		{input: "fanout . 127.0.0.1 {\nserve-stale 1h 30s 1\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nexpire -1s\n}", expectedErr: "expire can't be negative"},
+		{input: "fanout . 127.0.0.1 {\nexpire\n}", expectedErr: "Wrong argument count or unexpected line ending"},
+		{input: "fanout . 127.0.0.1 {\nmax-idle-conns -1\n}", expectedErr: "Wrong argument count or unexpected line ending"},
 	}
 
 	for i, test := range tests {
@@ -183,3 +259,301 @@ nameserver 10.10.255.253`), 0o600); err != nil {
 		}
 	}
 }
+
+func TestSetupDoH(t *testing.T) {
+	c := caddy.NewTestController("dns", "fanout . https://127.0.0.1 https://127.0.0.2:8443/resolve {\ndoh-method get\ntls-server dns.example.com\n}")
+	f, err := parseFanout(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expectedURLs := []string{"https://127.0.0.1:443/dns-query", "https://127.0.0.2:8443/resolve"}
+	for i, expected := range expectedURLs {
+		tr, ok := f.clients[i].(*client).transport.(*dohTransport)
+		if !ok {
+			t.Fatalf("Test %d: expected DoH transport, got: %T", i, f.clients[i].(*client).transport)
+		}
+		if tr.url != expected || tr.method != "GET" {
+			t.Fatalf("Test %d: expected: GET %s, got: %s %s", i, expected, tr.method, tr.url)
+		}
+		if tr.tlsConfig == nil || tr.tlsConfig.ServerName != "dns.example.com" {
+			t.Fatalf("Test %d: expected tls server name to be set", i)
+		}
+	}
+}
+
+func TestSetupServerNames(t *testing.T) {
+	c := caddy.NewTestController("dns", `fanout . tls://1.1.1.1@cloudflare-dns.com "tls://9.9.9.9#dns.quad9.net" tls://8.8.8.8 "https://127.0.0.3/resolve#doh.example" {
+		tls-server dns.google
+		upstream tls://1.1.1.1@cloudflare-dns.com {
+			weight 10
+		}
+	}`)
+	f, err := parseFanout(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expectedTo := []string{"1.1.1.1:853", "9.9.9.9:853", "8.8.8.8:853", "127.0.0.3:443"}
+	if to := endpoints(f.clients); !reflect.DeepEqual(to, expectedTo) {
+		t.Fatalf("Expected: %q, actual: %q", expectedTo, to)
+	}
+	configs := []*tls.Config{
+		f.clients[0].(*client).transport.(*transportImpl).tlsConfig,
+		f.clients[1].(*client).transport.(*transportImpl).tlsConfig,
+		f.clients[2].(*client).transport.(*transportImpl).tlsConfig,
+		f.clients[3].(*client).transport.(*dohTransport).tlsConfig,
+	}
+	for i, expected := range []string{"cloudflare-dns.com", "dns.quad9.net", "dns.google", "doh.example"} {
+		if configs[i].ServerName != expected {
+			t.Fatalf("Test %d: expected server name %s, got: %s", i, expected, configs[i].ServerName)
+		}
+		if configs[i] == f.tlsConfig {
+			t.Fatalf("Test %d: expected TLS config to be cloned per client", i)
+		}
+	}
+	if url := f.clients[3].(*client).transport.(*dohTransport).url; url != "https://127.0.0.3:443/resolve" {
+		t.Fatalf("Expected DoH URL without server name, got: %s", url)
+	}
+	if u := f.upstream("tls://1.1.1.1:853#cloudflare-dns.com"); u == nil || u.weight != 10 {
+		t.Fatalf("Expected the upstream block to match the upstream address, got: %+v", u)
+	}
+}
+
+func TestSetupHealthCheck(t *testing.T) {
+	c := caddy.NewTestController("dns", "fanout . 127.0.0.1 127.0.0.2 {\nhealth-check 5s\nhealth-check-query example.org\nhealth-check-fails 3\nhealth-check-successes 2\nhealth-check-all-down servfail\n}")
+	f, err := parseFanout(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := HealthCheck{Query: "example.org.", Interval: 5 * time.Second, Fails: 3, Successes: 2}
+	for i := range f.clients {
+		if hc := f.clients[i].(*client).health.HealthCheck; hc != expected {
+			t.Fatalf("Test %d: expected: %v, got: %v", i, expected, hc)
+		}
+	}
+	if !f.allDownServFail {
+		t.Fatal("Expected servfail all-down mode to be set")
+	}
+}
+
+func TestSetupCircuitBreaker(t *testing.T) {
+	c := caddy.NewTestController("dns", "fanout . 127.0.0.1 127.0.0.2 {\ncircuit-breaker-failures 3\ncircuit-breaker-servfail-rate 0.3 50\ncircuit-breaker-ejection 1s 1m\n}")
+	f, err := parseFanout(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := CircuitBreaker{Failures: 3, ServFailRate: 0.3, Window: 50, BaseEjection: time.Second, MaxEjection: time.Minute}
+	for i := range f.clients {
+		if cb := f.clients[i].(*client).breaker.CircuitBreaker; cb != expected {
+			t.Fatalf("Test %d: expected: %v, got: %v", i, expected, cb)
+		}
+	}
+}
+
+func TestSetupHedge(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedHedge bool
+		expectedDelay time.Duration
+	}{
+		{input: "fanout . 127.0.0.1 127.0.0.2", expectedHedge: false, expectedDelay: 0},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\nhedge 50ms\n}", expectedHedge: true, expectedDelay: 50 * time.Millisecond},
+		{input: "fanout . 127.0.0.1 127.0.0.2 {\nhedge AUTO\n}", expectedHedge: true, expectedDelay: 0},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseFanout(c)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %v", i, err)
+		}
+		if f.hedge != test.expectedHedge || f.hedgeDelay != test.expectedDelay {
+			t.Fatalf("Test %d: expected: %v %v, got: %v %v", i, test.expectedHedge, test.expectedDelay, f.hedge, f.hedgeDelay)
+		}
+	}
+}
+
+func TestSetupCache(t *testing.T) {
+	c := caddy.NewTestController("dns", "fanout . 127.0.0.1 {\ncache 100\ncache-max-ttl 10m 1m\nprefetch 5 30s 20%\n}")
+	f, err := parseFanout(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := CacheConfig{
+		Capacity:           100,
+		MaxTTL:             10 * time.Minute,
+		MaxNegativeTTL:     time.Minute,
+		PrefetchAmount:     5,
+		PrefetchDuration:   30 * time.Second,
+		PrefetchPercentage: 20,
+	}
+	if f.cache == nil || f.cache.CacheConfig != expected {
+		t.Fatalf("Expected cache: %+v, got: %+v", expected, f.cacheConfig)
+	}
+
+	c = caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nserve-stale 2h 10s\n}")
+	f, err = parseFanout(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if f.cacheConfig.Capacity != 0 || f.cache == nil || f.cache.StaleDuration != 2*time.Hour || f.cache.StaleTTL != 10*time.Second {
+		t.Fatalf("Expected serve-stale store, got: %+v", f.cacheConfig)
+	}
+}
+
+func TestSetupPrefer(t *testing.T) {
+	c := caddy.NewTestController("dns", "fanout . 127.0.0.1 {\nprefer answer NXDOMAIN nodata ad no-tc\nprefer-finish answer nxdomain\n}")
+	f, err := parseFanout(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := &preference{
+		ranks:       map[string]int{classAnswer: 0, classNXDomain: 1, classNoData: 2},
+		defaultRank: 3,
+		tiebreaks:   []string{tiebreakAD, tiebreakNoTC},
+		finish:      map[string]bool{classAnswer: true, classNXDomain: true},
+	}
+	if !reflect.DeepEqual(f.preference, expected) {
+		t.Fatalf("Expected: %+v, got: %+v", expected, f.preference)
+	}
+}
+
+func TestSetupRoutes(t *testing.T) {
+	c := caddy.NewTestController("dns", `fanout . 127.0.0.1 {
+	route corp.example 10.1.0.1 10.1.0.2 {
+		policy fastest
+		network tcp
+	}
+	route lab.corp.example. 10.2.0.1
+	race
+}`)
+	f, err := parseFanout(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !f.race || len(f.routes) != 2 {
+		t.Fatalf("Expected race and 2 routes, got: %v %d", f.race, len(f.routes))
+	}
+	corp := f.routes["corp.example."]
+	if corp == nil || corp.from != "corp.example." || corp.policyType != policyFastest || corp.net != tcp || corp.race {
+		t.Fatalf("Unexpected route corp.example.: %+v", corp)
+	}
+	if to := endpoints(corp.clients); !reflect.DeepEqual(to, []string{"10.1.0.1:53", "10.1.0.2:53"}) {
+		t.Fatalf("Unexpected upstreams of route corp.example.: %q", to)
+	}
+	lab := f.routes["lab.corp.example."]
+	if lab == nil || lab.net != udp || !reflect.DeepEqual(endpoints(lab.clients), []string{"10.2.0.1:53"}) {
+		t.Fatalf("Unexpected route lab.corp.example.: %+v", lab)
+	}
+	for name, expected := range map[string]*Fanout{"a.lab.corp.example.": lab, "corp.example.": corp, "www.corp.example.": corp, "example.": nil, "acorp.example.": nil} {
+		if r := f.route(name); r != expected {
+			t.Fatalf("Unexpected route of %s", name)
+		}
+	}
+}
+
+func TestSetupRoutesMaxIPCount(t *testing.T) {
+	hosts := make([]string, maxIPCount)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("127.0.1.%d", i+1)
+	}
+	c := caddy.NewTestController("dns", fmt.Sprintf(`fanout . %s {
+	route corp.example 10.1.0.1
+}`, strings.Join(hosts, " ")))
+	err := setup(c)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("more than %d TOs configured: %d", maxIPCount, maxIPCount+1)) {
+		t.Fatalf("Expected the upstreams of the routes to be limited, got: %v", err)
+	}
+}
+
+func TestSetupTiers(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedTo      []string
+		expectedTiers   map[string][]string
+		expectedTimeout time.Duration
+	}{
+		{
+			input:           "fanout . 127.0.0.1 127.0.0.2 {\ntier backup 127.0.0.3\ntier public 8.8.8.8 1.1.1.1\ntier-timeout 500ms\n}",
+			expectedTo:      []string{"127.0.0.1:53", "127.0.0.2:53"},
+			expectedTiers:   map[string][]string{"backup": {"127.0.0.3:53"}, "public": {"8.8.8.8:53", "1.1.1.1:53"}},
+			expectedTimeout: 500 * time.Millisecond,
+		},
+		{
+			input:           "fanout . {\ntier primary 10.0.0.1 10.0.0.2\ntier backup 8.8.8.8\n}",
+			expectedTo:      []string{"10.0.0.1:53", "10.0.0.2:53"},
+			expectedTiers:   map[string][]string{"backup": {"8.8.8.8:53"}},
+			expectedTimeout: defaultTierTimeout,
+		},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseFanout(c)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %v", i, err)
+		}
+		if to := endpoints(f.clients); !reflect.DeepEqual(to, test.expectedTo) {
+			t.Fatalf("Test %d: expected: %q, actual: %q", i, test.expectedTo, to)
+		}
+		if len(f.tiers) != len(test.expectedTiers) {
+			t.Fatalf("Test %d: expected %d tiers, got: %d", i, len(test.expectedTiers), len(f.tiers))
+		}
+		for _, tier := range f.tiers {
+			if to := endpoints(tier.clients); !reflect.DeepEqual(to, test.expectedTiers[tier.name]) {
+				t.Fatalf("Test %d: tier %s expected: %q, actual: %q", i, tier.name, test.expectedTiers[tier.name], to)
+			}
+			if tier.workerCount != len(tier.clients) || tier.serverCount != len(tier.clients) || tier.policy == nil {
+				t.Fatalf("Test %d: tier %s isn't initialized", i, tier.name)
+			}
+		}
+		if f.tierTimeout != test.expectedTimeout {
+			t.Fatalf("Test %d: expected: %v, got: %v", i, test.expectedTimeout, f.tierTimeout)
+		}
+	}
+}
+
+func TestSetupUpstreams(t *testing.T) {
+	input := `fanout . 127.0.0.1 tls://9.9.9.9 {
+		tls
+		tls-server default.example
+		policy weighted-random
+		upstream tls://9.9.9.9 {
+			tls-server dns.quad9.net
+			weight 80
+			timeout 1s
+		}
+		upstream 127.0.0.2 {
+			network tcp
+		}
+		upstream 127.0.0.3
+	}`
+	f, err := parseFanout(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expectedTo := []string{"127.0.0.1:53", "9.9.9.9:853", "127.0.0.2:53", "127.0.0.3:53"}
+	if to := endpoints(f.clients); !reflect.DeepEqual(to, expectedTo) {
+		t.Fatalf("Expected: %q, actual: %q", expectedTo, to)
+	}
+	if lf := f.serverSelectionPolicy.(*weightedPolicy).loadFactor; !reflect.DeepEqual(lf, []int{100, 80, 100, 100}) {
+		t.Fatalf("Expected weights of upstreams to be applied, got: %v", lf)
+	}
+	if f.clientTimeouts[f.clients[1]] != time.Second || len(f.clientTimeouts) != 1 {
+		t.Fatalf("Expected the timeout of upstream 9.9.9.9, got: %v", f.clientTimeouts)
+	}
+	if name := f.clients[1].(*client).transport.(*transportImpl).tlsConfig.ServerName; name != "dns.quad9.net" {
+		t.Fatalf("Expected server name dns.quad9.net, got: %s", name)
+	}
+	if f.tlsConfig.ServerName != "default.example" {
+		t.Fatalf("Expected global server name not to be changed, got: %s", f.tlsConfig.ServerName)
+	}
+	if net := f.clients[2].(*client).net; net != tcp {
+		t.Fatalf("Expected network tcp for upstream 127.0.0.2, got: %s", net)
+	}
+}
+
+func endpoints(clients []Client) []string {
+	var to []string
+	for _, c := range clients {
+		to = append(to, c.Endpoint())
+	}
+	return to
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// tier is a group of upstreams which is requested only if the previous tier has failed
+type tier struct {
+	name        string
+	hosts       []string
+	clients     []Client
+	policy      policy
+	workerCount int
+	serverCount int
+}
+
+// hasHealthyClients returns true if at least one client of the tier isn't marked as down by health checks
+func (t *tier) hasHealthyClients() bool {
+	for _, c := range t.clients {
+		if c.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// failed returns true if the result of a tier should be escalated to the next tier
+func failed(result *response) bool {
+	return result == nil || result.err != nil || result.response == nil || result.response.Rcode == dns.RcodeServerFailure
+}
+
+// requestTiers requests the tiers one by one until a tier answers without errors and SERVFAIL.
+// Each tier except the last one is limited by tierTimeout.
+func (f *Fanout) requestTiers(ctx context.Context, req *request.Request) *response {
+	primary := tier{
+		clients:     f.clients,
+		policy:      f.serverSelectionPolicy,
+		workerCount: f.workerCount,
+		serverCount: f.serverCount,
+	}
+	anyHealthy := f.hasHealthyClients()
+
+	var result *response
+	for i := 0; i <= len(f.tiers); i++ {
+		t := &primary
+		if i > 0 {
+			t = f.tiers[i-1]
+		}
+		last := i == len(f.tiers)
+		if !last && anyHealthy && !t.hasHealthyClients() {
+			continue
+		}
+
+		tierCtx, cancel := ctx, context.CancelFunc(func() {})
+		if !last && f.tierTimeout > 0 {
+			tierCtx, cancel = context.WithTimeout(ctx, f.tierTimeout)
+		}
+		r := f.getFanoutResult(tierCtx, f.runWorkers(tierCtx, t, req))
+		cancel()
+
+		if result == nil || !f.preference.isBetter(r, result) {
+			result = r
+		}
+		if !failed(r) || ctx.Err() != nil {
+			return result
+		}
+		if !last {
+			log.Debugf("request %s %s is escalated to tier %s", req.Name(), req.Type(), f.tiers[i].name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func newTierFanout(primary, backup string) *Fanout {
+	f := New()
+	f.from = "."
+	f.attempts = 1
+	f.addClient(NewClient(primary, udp))
+	backupClients := []Client{NewClient(backup, udp)}
+	f.tiers = []*tier{{
+		name:        "backup",
+		clients:     backupClients,
+		policy:      &sequentialPolicy{},
+		workerCount: 1,
+		serverCount: 1,
+	}}
+	return f
+}
+
+func TestFanout_TierEscalation(t *testing.T) {
+	testCases := map[string]struct {
+		primary         func(w dns.ResponseWriter, r *dns.Msg)
+		expectedRcode   int
+		expectedBackups int32
+	}{
+		"primary_success": {
+			primary: func(w dns.ResponseWriter, r *dns.Msg) {
+				msg := new(dns.Msg)
+				msg.SetRcode(r, dns.RcodeNameError)
+				logErrIfNotNil(w.WriteMsg(msg))
+			},
+			expectedRcode:   dns.RcodeNameError,
+			expectedBackups: 0,
+		},
+		"primary_servfail": {
+			primary: func(w dns.ResponseWriter, r *dns.Msg) {
+				msg := new(dns.Msg)
+				msg.SetRcode(r, dns.RcodeServerFailure)
+				logErrIfNotNil(w.WriteMsg(msg))
+			},
+			expectedRcode:   dns.RcodeSuccess,
+			expectedBackups: 1,
+		},
+		"primary_timeout": {
+			primary:         func(dns.ResponseWriter, *dns.Msg) {},
+			expectedRcode:   dns.RcodeSuccess,
+			expectedBackups: 1,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			defer goleak.VerifyNone(t)
+			primary := newServer(udp, tc.primary)
+			defer primary.close()
+			var backupQueries int32
+			backup := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+				atomic.AddInt32(&backupQueries, 1)
+				msg := new(dns.Msg)
+				msg.SetReply(r)
+				logErrIfNotNil(w.WriteMsg(msg))
+			})
+			defer backup.close()
+
+			f := newTierFanout(primary.addr, backup.addr)
+			f.tierTimeout = 200 * time.Millisecond
+
+			req := new(dns.Msg)
+			req.SetQuestion(testQuery, dns.TypeA)
+			writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+			start := time.Now()
+			_, err := f.ServeDNS(context.TODO(), writer, req)
+			require.NoError(t, err)
+			require.Less(t, time.Since(start), time.Second)
+			require.Len(t, writer.answers, 1)
+			require.Equal(t, tc.expectedRcode, writer.answers[0].Rcode)
+			require.Equal(t, tc.expectedBackups, atomic.LoadInt32(&backupQueries))
+		})
+	}
+}
+
+func TestFanout_TierKeepsBetterResult(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	primary := newServer(udp, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer primary.close()
+	backup := newServer(udp, func(dns.ResponseWriter, *dns.Msg) {})
+	defer backup.close()
+
+	f := newTierFanout(primary.addr, backup.addr)
+	f.timeout = 300 * time.Millisecond
+
+	req := new(dns.Msg)
+	req.SetQuestion(testQuery, dns.TypeA)
+	writer := &cachedDNSWriter{ResponseWriter: new(test.ResponseWriter)}
+	_, err := f.ServeDNS(context.TODO(), writer, req)
+	require.NoError(t, err)
+	require.Len(t, writer.answers, 1)
+	require.Equal(t, dns.RcodeServerFailure, writer.answers[0].Rcode)
+}
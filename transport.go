@@ -20,6 +20,9 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	ot "github.com/opentracing/opentracing-go"
@@ -27,20 +30,39 @@ import (
 
 // Transport represent a solution to connect to remote DNS endpoint with specific network
 type Transport interface {
-	Dial(ctx context.Context, net string) (*dns.Conn, error)
+	Dial(ctx context.Context, net string) (*dns.Conn, bool, error)
+	Yield(net string, conn *dns.Conn)
 	SetTLSConfig(*tls.Config)
+	SetExpire(time.Duration)
+	SetMaxIdleConns(int)
+	Start()
+	Stop()
 }
 
 // NewTransport creates new transport with address
 func NewTransport(addr string) Transport {
 	return &transportImpl{
-		addr: addr,
+		addr:         addr,
+		expire:       defaultExpire,
+		maxIdleConns: defaultMaxIdleConns,
+		conns:        map[string][]*persistConn{},
 	}
 }
 
+// persistConn holds the idle dns.Conn and the last used time.
+type persistConn struct {
+	c    *dns.Conn
+	used time.Time
+}
+
 type transportImpl struct {
-	tlsConfig *tls.Config
-	addr      string
+	tlsConfig    *tls.Config
+	addr         string
+	expire       time.Duration
+	maxIdleConns int
+	mu           sync.Mutex
+	conns        map[string][]*persistConn
+	stop         chan struct{}
 }
 
 // SetTLSConfig sets tls config for transport
@@ -48,15 +70,126 @@ func (t *transportImpl) SetTLSConfig(c *tls.Config) {
 	t.tlsConfig = c
 }
 
+// SetExpire sets the duration after which an idle connection is closed
+func (t *transportImpl) SetExpire(expire time.Duration) {
+	t.expire = expire
+}
+
+// SetMaxIdleConns sets the maximum number of idle connections kept per network. Zero disables pooling.
+func (t *transportImpl) SetMaxIdleConns(n int) {
+	t.maxIdleConns = n
+}
+
+// Start starts the goroutine evicting expired idle connections.
+func (t *transportImpl) Start() {
+	if t.expire <= 0 {
+		return
+	}
+	t.stop = make(chan struct{})
+	go t.cleanupLoop(t.stop)
+}
+
+// Stop stops the eviction goroutine and closes all idle connections.
+func (t *transportImpl) Stop() {
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+	t.cleanup(true)
+}
+
 // Dial dials the address configured in transportImpl, potentially reusing a connection or creating a new one.
-func (t *transportImpl) Dial(ctx context.Context, network string) (*dns.Conn, error) {
-	if t.tlsConfig != nil {
-		network = tcptls
+// The returned flag reports whether the connection was taken from the pool.
+func (t *transportImpl) Dial(ctx context.Context, network string) (*dns.Conn, bool, error) {
+	network = t.network(network)
+	if conn := t.pop(network); conn != nil {
+		return conn, true, nil
 	}
+	var conn *dns.Conn
+	var err error
 	if network == tcptls {
-		return t.dial(ctx, &dns.Client{Net: network, Dialer: &net.Dialer{Timeout: maxTimeout}, TLSConfig: t.tlsConfig})
+		conn, err = t.dial(ctx, &dns.Client{Net: network, Dialer: &net.Dialer{Timeout: maxTimeout}, TLSConfig: t.tlsConfig})
+	} else {
+		conn, err = t.dial(ctx, &dns.Client{Net: network, Dialer: &net.Dialer{Timeout: maxTimeout}})
+	}
+	return conn, false, err
+}
+
+// Yield returns the healthy connection to the pool for reuse.
+func (t *transportImpl) Yield(network string, conn *dns.Conn) {
+	network = t.network(network)
+	t.mu.Lock()
+	if t.expire > 0 && len(t.conns[network]) < t.maxIdleConns {
+		t.conns[network] = append(t.conns[network], &persistConn{c: conn, used: time.Now()})
+		conn = nil
+	}
+	t.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+func (t *transportImpl) network(network string) string {
+	if t.tlsConfig != nil {
+		return tcptls
+	}
+	return network
+}
+
+// pop takes the most recently used connection from the pool. Expired connections are closed.
+func (t *transportImpl) pop(network string) *dns.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stack := t.conns[network]
+	if len(stack) == 0 {
+		return nil
+	}
+	pc := stack[len(stack)-1]
+	if time.Since(pc.used) < t.expire {
+		t.conns[network] = stack[:len(stack)-1]
+		return pc.c
+	}
+	// connections in stack are sorted by "used", so the whole stack is expired
+	t.conns[network] = nil
+	closeConns(stack)
+	return nil
+}
+
+func (t *transportImpl) cleanupLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.expire)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			t.cleanup(false)
+		}
+	}
+}
+
+// cleanup closes expired idle connections or all of them if all is true.
+func (t *transportImpl) cleanup(all bool) {
+	staleTime := time.Now().Add(-t.expire)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for network, stack := range t.conns {
+		stale := len(stack)
+		if !all {
+			// connections in stack are sorted by "used"
+			stale = sort.Search(len(stack), func(i int) bool {
+				return stack[i].used.After(staleTime)
+			})
+		}
+		closeConns(stack[:stale])
+		t.conns[network] = stack[stale:]
+	}
+}
+
+func closeConns(conns []*persistConn) {
+	for _, pc := range conns {
+		_ = pc.c.Close()
 	}
-	return t.dial(ctx, &dns.Client{Net: network, Dialer: &net.Dialer{Timeout: maxTimeout}})
 }
 
 func (t *transportImpl) dial(ctx context.Context, c *dns.Client) (*dns.Conn, error) {
@@ -0,0 +1,112 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestClient_ReusesConnection(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var mutex sync.Mutex
+	remotes := map[string]struct{}{}
+	s := newServer(tcp, func(w dns.ResponseWriter, r *dns.Msg) {
+		mutex.Lock()
+		remotes[w.RemoteAddr().String()] = struct{}{}
+		mutex.Unlock()
+		msg := dns.Msg{
+			Answer: []dns.RR{makeRecordA("example1. 3600	IN	A 10.0.0.1")},
+		}
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(&msg))
+	})
+	defer s.close()
+	c := NewClient(s.addr, tcp)
+	c.Start()
+	defer c.Stop()
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		d, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.Nil(t, err)
+		require.Len(t, d.Answer, 1)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, remotes, 1)
+}
+
+func TestClient_DoesNotReuseExpiredConnection(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var mutex sync.Mutex
+	remotes := map[string]struct{}{}
+	s := newServer(tcp, func(w dns.ResponseWriter, r *dns.Msg) {
+		mutex.Lock()
+		remotes[w.RemoteAddr().String()] = struct{}{}
+		mutex.Unlock()
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+	})
+	defer s.close()
+	c := NewClient(s.addr, tcp)
+	c.SetExpire(50 * time.Millisecond)
+	defer c.Stop()
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		_, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.Nil(t, err)
+		<-time.After(100 * time.Millisecond)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, remotes, 2)
+}
+
+func TestClient_RedialsClosedCachedConnection(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		logErrIfNotNil(w.WriteMsg(msg))
+		// close connection after the answer as a server with short idle timeout does
+		logErrIfNotNil(w.Close())
+	}
+	s := newServer(tcp, handler)
+	defer s.close()
+	c := NewClient(s.addr, tcp)
+	defer c.Stop()
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(testQuery, dns.TypeA)
+		_, err := c.Request(context.Background(), &request.Request{W: &test.ResponseWriter{}, Req: req})
+		require.Nil(t, err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2024 MWS and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"crypto/tls"
+	"slices"
+	"time"
+)
+
+// upstream holds the options overriding the global ones for a single upstream
+type upstream struct {
+	host          string
+	weight        int
+	timeout       time.Duration
+	net           string
+	tlsConfig     *tls.Config
+	tlsServerName string
+}
+
+// upstream returns the options of the host or nil if the host has no own options
+func (f *Fanout) upstream(host string) *upstream {
+	for _, u := range f.upstreams {
+		if u.host == host {
+			return u
+		}
+	}
+	return nil
+}
+
+// declared returns true if the host is listed in the hosts or in a tier
+func (f *Fanout) declared(host string, hosts []string) bool {
+	if slices.Contains(hosts, host) {
+		return true
+	}
+	for _, t := range f.tiers {
+		if slices.Contains(t.hosts, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfigOf returns the copy of the TLS config of the upstream. The server name of the upstream options
+// takes precedence over the server name of the upstream address, which takes precedence over the global one.
+func (f *Fanout) tlsConfigOf(u *upstream, serverName string) *tls.Config {
+	cfg := f.tlsConfig.Clone()
+	if u != nil && u.tlsConfig != nil {
+		cfg = u.tlsConfig.Clone()
+		cfg.ServerName = f.tlsServerName
+	}
+	if serverName != "" {
+		cfg.ServerName = serverName
+	}
+	if u != nil && u.tlsServerName != "" {
+		cfg.ServerName = u.tlsServerName
+	}
+	return cfg
+}
+
+// usesTLS returns true if the upstream is configured to be requested over TLS regardless of its scheme
+func (u *upstream) usesTLS() bool {
+	return u != nil && (u.tlsConfig != nil || u.tlsServerName != "" || u.net == tcptls)
+}